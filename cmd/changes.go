@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/nakamorg/calbridge/pkg/backend"
+	"github.com/nakamorg/calbridge/pkg/caldav"
+	"github.com/nakamorg/calbridge/pkg/config"
+	"github.com/nakamorg/calbridge/pkg/util"
+)
+
+const (
+	calendarSyncKeyPrefix = "caldav:sync:"
+	// pendingEventsKey holds the changed events which start after the time window in which
+	// invites are sent, by UID, with their start time
+	pendingEventsKey = "caldav:pending"
+)
+
+// calendarChanges are the changes of the user's calendars since the last sync
+type calendarChanges struct {
+	// Created and modified events which are not over yet
+	updated map[string]*ical.Calendar
+	// Events whose invites are due, the updated ones and the pending ones starting within the
+	// time window in which invites are sent
+	invites []*ical.Calendar
+	// UIDs of the deleted events
+	deleted map[string]bool
+
+	states  map[string]caldav.SyncState
+	pending map[string]time.Time
+}
+
+// readChanges returns the changes of the user's calendars since the last sync. The changes have to
+// be saved with saveChanges once they were processed.
+func readChanges(ctx context.Context, user config.User, calClient *caldav.Client, storage backend.Backend) (*calendarChanges, error) {
+	records, err := storage.ListState(ctx, user.Name, calendarSyncKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing calendar sync states: %v", err)
+	}
+	states := map[string]caldav.SyncState{}
+	for key, value := range records {
+		var state caldav.SyncState
+		if err := json.Unmarshal(value, &state); err != nil {
+			return nil, fmt.Errorf("failed decoding calendar sync state: %v", err)
+		}
+		states[strings.TrimPrefix(key, calendarSyncKeyPrefix)] = state
+	}
+	synced, states, err := calClient.SyncCalendars(ctx, states)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading calendar changes: %v", err)
+	}
+
+	changes := &calendarChanges{
+		updated: map[string]*ical.Calendar{},
+		deleted: map[string]bool{},
+		states:  states,
+		pending: map[string]time.Time{},
+	}
+	if err := backend.GetStateJSON(ctx, storage, user.Name, pendingEventsKey, &changes.pending); err != nil {
+		return nil, fmt.Errorf("failed reading pending events: %v", err)
+	}
+
+	now := time.Now()
+	windowStart, windowEnd := now.AddDate(0, 0, -1), now.AddDate(0, 0, user.CalDAV.EventDays)
+	for _, obj := range synced.Updated {
+		uid, err := util.EventUid(obj.Data)
+		if err != nil {
+			continue
+		}
+		delete(changes.pending, uid)
+		start, _ := util.EventDTStart(obj.Data)
+		end, _ := util.EventDTEnd(obj.Data)
+		if !end.IsZero() && end.Before(windowStart) {
+			continue
+		}
+		changes.updated[uid] = obj.Data
+		if start.After(windowEnd) {
+			changes.pending[uid] = start
+		} else {
+			changes.invites = append(changes.invites, obj.Data)
+		}
+	}
+	for _, uid := range synced.Deleted {
+		// Events moved between calendars are deleted from one and created in the other
+		if _, ok := changes.updated[uid]; !ok {
+			changes.deleted[uid] = true
+			delete(changes.pending, uid)
+		}
+	}
+
+	for uid, start := range changes.pending {
+		if start.After(windowEnd) {
+			continue
+		}
+		delete(changes.pending, uid)
+		obj, err := calClient.FindEvent(ctx, uid)
+		if err != nil {
+			return nil, fmt.Errorf("failed finding event %s: %v", uid, err)
+		}
+		if obj != nil {
+			changes.invites = append(changes.invites, obj.Data)
+		}
+	}
+	return changes, nil
+}
+
+// saveChanges stores how far the changes of the user's calendars were processed
+func saveChanges(ctx context.Context, username string, changes *calendarChanges, storage backend.Backend) error {
+	for path, state := range changes.states {
+		if err := backend.PutStateJSON(ctx, storage, username, calendarSyncKeyPrefix+path, state); err != nil {
+			return fmt.Errorf("failed setting calendar sync state: %v", err)
+		}
+	}
+	if err := backend.PutStateJSON(ctx, storage, username, pendingEventsKey, changes.pending); err != nil {
+		return fmt.Errorf("failed setting pending events: %v", err)
+	}
+	return nil
+}
@@ -5,10 +5,14 @@ import (
 	"context"
 	"crypto/md5"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/emersion/go-ical"
@@ -20,98 +24,388 @@ import (
 )
 
 func main() {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	configFlag := flag.String("config", "", "path of the config file, in json, yaml or toml (env "+configEnv+")")
+	dataDirFlag := flag.String("data-dir", "", "directory the data is stored in (env "+dataDirEnv+")")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: calbridge [--config file] [--data-dir dir] [run | user ... | secrets ...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
 	var err error
-	var users []config.User
+	var conf config.Config
 	var storage backend.Backend
-	var configFolder string
-	configFolder, err = configFolderPath()
+	configFilePath, dataDir, err := resolvePaths(*configFlag, *dataDirFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	args := flag.Args()
+	command := ""
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "", "run", "secrets", "user":
+	default:
+		log.Fatalf("unknown command %q. Run without arguments to sync once, use `run` to sync continuously, `user` to manage the users or `secrets` to manage the stored secrets", command)
+	}
+
+	storageConf, err := config.LoadStorage(configFilePath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// Users and secrets would be lost as soon as the command exits
+	if (command == "secrets" || command == "user") && storageType(storageConf) == backend.TypeMemory {
+		log.Fatalf("`calbridge %s` needs a persistent storage, the %s storage keeps nothing once calbridge exits", command, backend.TypeMemory)
+	}
+	if storage, err = openStorage(storageConf, dataDir); err != nil {
+		log.Fatalf("Failed to create storage: %v", err)
+	}
+	defer storage.Close()
+	vault := vaultOpener(storage)
+
+	if command == "secrets" || command == "user" {
+		if command == "secrets" {
+			err = runSecrets(ctx, args, storage)
+		} else {
+			err = runUserCommand(ctx, args, configFilePath, storage)
+		}
+		if err != nil {
+			log.Print(err)
+			storage.Close()
+			os.Exit(1)
+		}
+		return
+	}
 
-	configFilePath := filepath.Join(configFolder, "config.json")
-	if users, err = config.LoadUsersFromConfig(configFilePath); err != nil {
-		if errors.Is(err, os.ErrNotExist) {
+	loader := &userLoader{configPath: configFilePath, storage: storage, vault: vault}
+	if conf, err = loader.load(ctx); err != nil {
+		if errors.Is(err, errNoUsers) {
 			log.Printf("could not find the config file. A sample config file will be created for you at %s\n", configFilePath)
 			if err := config.CreateSampleConfig(configFilePath); err != nil {
 				log.Fatalf("failed creating sample config file: %v", err)
 			}
-			log.Fatal("update the sample file with real configuration data")
-		} else {
-			log.Fatal(err)
+			log.Fatal("update the sample file with real configuration data or add users with `calbridge user add`")
 		}
+		// Invalid configs, secrets which can not be resolved and unreadable users must not look
+		// like a success to cron or systemd
+		log.Print(err)
+		storage.Close()
+		os.Exit(1)
 	}
 
-	if storage, err = backend.NewBoltBackend(filepath.Join(configFolder, "bolt.db")); err != nil {
-		log.Fatalf("Failed to create storage: %v", err)
-	}
-	defer storage.Close()
-
-	for _, user := range users {
-		if err := handleUser(ctx, user, storage); err != nil {
+	if command == "run" {
+		if err := runDaemon(ctx, conf, loader.reload, storage); err != nil {
 			log.Print(err)
 		}
+		return
+	}
+
+	if err := handleUsers(ctx, conf.Users, conf.Concurrency, storage); err != nil {
+		log.Print(err)
+		storage.Close()
+		os.Exit(1)
 	}
 }
 
-func configFolderPath() (string, error) {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return "", err
+// handleUsers syncs all the users once, running at most concurrency of them at the same time.
+// A failing user does not affect the others, the errors of all the failed users are returned together.
+func handleUsers(ctx context.Context, users []config.User, concurrency int, storage backend.Backend) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(users))
+	sem := make(chan struct{}, concurrency)
+	for i, user := range users {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = handleUser(ctx, user, storage)
+		}()
+	}
+	wg.Wait()
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	log.Printf("synced %d of %d users", len(users)-len(failed), len(users))
+	if len(failed) != 0 {
+		return fmt.Errorf("%d users failed to sync:\n%w", len(failed), errors.Join(failed...))
 	}
-	return filepath.Join(homeDir, ".calbridge"), nil
+	return nil
 }
 
+// handleUser syncs the events and invites of a user once
 func handleUser(ctx context.Context, user config.User, storage backend.Backend) error {
-	var err error
-	var calClient *caldav.Client
-	var smtpClient *email.SMTPClient
-	var imapClient *email.IMAPClient
+	s := newSession(user, storage)
+	defer s.Close()
+	return s.sync(ctx)
+}
+
+// session holds the CalDAV, SMTP and IMAP clients of a user so that they can be reused
+// across syncs. Clients are created lazily and dropped whenever a sync fails.
+type session struct {
+	user    config.User
+	storage backend.Backend
 
-	if calClient, err = caldav.NewClient(user.CalDAV.Username, user.CalDAV.Password, user.CalDAV.URL); err != nil {
-		return fmt.Errorf("failed to create caldav client: %w", err)
+	// mu serializes the syncs of the user as the clients do not support concurrent use
+	mu         sync.Mutex
+	calClient  *caldav.Client
+	smtpClient *email.SMTPClient
+	imapClient *email.IMAPClient
+}
+
+func newSession(user config.User, storage backend.Backend) *session {
+	return &session{
+		user:    user,
+		storage: storage,
 	}
+}
+
+// connect creates the clients which are missing or whose connections are no longer usable
+func (s *session) connect(ctx context.Context) error {
+	var err error
+	user := s.user
 
-	if smtpClient, err = email.NewSMTPClient(user.SMTP.Username, user.SMTP.Password, user.SMTP.Host, "587"); err != nil {
-		return fmt.Errorf("failed to create smtp client: %w", err)
+	if s.calClient == nil {
+		if s.calClient, err = newCalDAVClient(ctx, user, s.storage); err != nil {
+			return fmt.Errorf("failed to create caldav client: %w", err)
+		}
 	}
-	defer smtpClient.Close()
 
-	if imapClient, err = email.NewIMAPClient(user.IMAP.Username, user.IMAP.Password, user.IMAP.Host, "993"); err != nil {
-		return fmt.Errorf("failed to create imap client: %w", err)
+	if s.smtpClient != nil && s.smtpClient.Noop() != nil {
+		s.smtpClient.Close()
+		s.smtpClient = nil
+	}
+	if s.smtpClient == nil {
+		if s.smtpClient, err = newSMTPClient(ctx, user, s.storage); err != nil {
+			return fmt.Errorf("failed to create smtp client: %w", err)
+		}
 	}
-	defer imapClient.Close()
 
-	if err = sendInvites(ctx, user.Name, user.CalDAV.EventDays, calClient, smtpClient, storage); err != nil {
-		log.Fatal(err)
+	if s.imapClient != nil && s.imapClient.Noop() != nil {
+		s.imapClient.Close()
+		s.imapClient = nil
 	}
+	if s.imapClient == nil {
+		if s.imapClient, err = newIMAPClient(ctx, user, s.storage); err != nil {
+			return fmt.Errorf("failed to create imap client: %w", err)
+		}
+	}
+	return nil
+}
 
-	if err = addInvites(ctx, user.Name, user.IMAP.EmailHours, calClient, imapClient, storage); err != nil {
-		log.Fatal(err)
+// sync sends the invites for the upcoming events of the user and adds the received invites
+// to the user's calendar.
+func (s *session) sync(ctx context.Context) error {
+	return s.do(ctx, func() error {
+		if err := sendInvites(ctx, s.user, s.calClient, s.smtpClient, s.storage); err != nil {
+			return err
+		}
+		for _, mailbox := range s.user.IMAP.MailboxNames() {
+			if err := addInvites(ctx, s.user, mailbox, s.calClient, s.imapClient, s.storage); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// importInvites only adds the received invites from mailbox to the user's calendar
+func (s *session) importInvites(ctx context.Context, mailbox string) error {
+	return s.do(ctx, func() error {
+		return addInvites(ctx, s.user, mailbox, s.calClient, s.imapClient, s.storage)
+	})
+}
+
+// do connects the clients and runs f. The connections are closed if anything fails, the
+// next sync reconnects.
+func (s *session) do(ctx context.Context, f func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.connect(ctx)
+	if err == nil {
+		err = f()
+	}
+	if err != nil {
+		s.close()
+		return fmt.Errorf("failed syncing user %s: %w", s.user.Name, err)
 	}
 	return nil
 }
 
-func sendInvites(ctx context.Context, username string, eventDays int, calClient *caldav.Client, smtpClient *email.SMTPClient, storage backend.Backend) error {
-	var events []*ical.Calendar
+// Close closes the SMTP and IMAP sessions of the user
+func (s *session) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.close()
+}
+
+func (s *session) close() {
+	if s.smtpClient != nil {
+		s.smtpClient.Close()
+		s.smtpClient = nil
+	}
+	if s.imapClient != nil {
+		s.imapClient.Close()
+		s.imapClient = nil
+	}
+	s.calClient = nil
+}
+
+const (
+	// discoveryTTL is how long the URL discovered for a CalDAV server is used before discovering it again
+	discoveryTTL       = 24 * time.Hour
+	caldavDiscoveryKey = "caldav:discovery"
+)
+
+// caldavDiscovery is the calendar home set URL discovered for a CalDAV server
+type caldavDiscovery struct {
+	Server string    `json:"server"`
+	URL    string    `json:"url"`
+	Time   time.Time `json:"time"`
+}
+
+// newCalDAVClient returns a client for the user's CalDAV server. When only the domain or the base
+// URL of the server is configured, the calendars are discovered and the discovered URL is kept
+// in the storage.
+func newCalDAVClient(ctx context.Context, user config.User, storage backend.Backend) (*caldav.Client, error) {
+	tokens, err := newTokenSource(ctx, user.Name, "caldav", user.CalDAV.OAuth2, storage)
+	if err != nil {
+		return nil, err
+	}
+	creds := caldav.Credentials{
+		Username: user.CalDAV.Username,
+		Password: user.CalDAV.Password,
+		Auth:     user.CalDAV.Auth,
+		Tokens:   tokens,
+	}
+
+	endpoint := user.CalDAV.URL
+	if caldav.NeedsDiscovery(endpoint) {
+		var discovery caldavDiscovery
+		if err := backend.GetStateJSON(ctx, storage, user.Name, caldavDiscoveryKey, &discovery); err != nil {
+			return nil, err
+		}
+		if discovery.Server != endpoint || time.Since(discovery.Time) > discoveryTTL {
+			discovered, err := caldav.Discover(ctx, creds, endpoint)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("discovered the calendars of %s at %s", user.Name, discovered)
+			discovery = caldavDiscovery{Server: endpoint, URL: discovered, Time: time.Now()}
+			if err := backend.PutStateJSON(ctx, storage, user.Name, caldavDiscoveryKey, discovery); err != nil {
+				return nil, err
+			}
+		}
+		endpoint = discovery.URL
+	}
+
+	c, err := caldav.NewClient(creds, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	c.SetCalendars(user.CalDAV.Calendars, user.CalDAV.ImportCalendar)
+	c.SetAddress(user.SMTP.Username)
+	return c, nil
+}
+
+func newSMTPClient(ctx context.Context, user config.User, storage backend.Backend) (*email.SMTPClient, error) {
+	server, err := mailServer(user.SMTP.Host, user.SMTP.Connection)
+	if err != nil {
+		return nil, err
+	}
+	var loc *time.Location
+	if user.SMTP.TimeZone != "" {
+		if loc, err = time.LoadLocation(user.SMTP.TimeZone); err != nil {
+			return nil, fmt.Errorf("invalid time zone: %w", err)
+		}
+	}
+	templates, err := email.LoadTemplates(user.SMTP.TemplateDir, loc)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading email templates: %w", err)
+	}
+
+	tokens, err := newTokenSource(ctx, user.Name, "smtp", user.SMTP.OAuth2, storage)
+	if err != nil {
+		return nil, err
+	}
+	c, err := email.NewSMTPClient(ctx, email.Credentials{
+		Username:  user.SMTP.Username,
+		Password:  user.SMTP.Password,
+		Tokens:    tokens,
+		Mechanism: oauth2Mechanism(user.SMTP.OAuth2),
+	}, server)
+	if err != nil {
+		return nil, err
+	}
+	c.SetTemplates(templates)
+	return c, nil
+}
+
+func newIMAPClient(ctx context.Context, user config.User, storage backend.Backend) (*email.IMAPClient, error) {
+	server, err := mailServer(user.IMAP.Host, user.IMAP.Connection)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := newTokenSource(ctx, user.Name, "imap", user.IMAP.OAuth2, storage)
+	if err != nil {
+		return nil, err
+	}
+	return email.NewIMAPClient(ctx, email.Credentials{
+		Username:  user.IMAP.Username,
+		Password:  user.IMAP.Password,
+		Tokens:    tokens,
+		Mechanism: oauth2Mechanism(user.IMAP.OAuth2),
+	}, server)
+}
+
+func mailServer(host string, conn config.Connection) (email.Server, error) {
+	tlsConfig, err := conn.TLSConfig(host)
+	if err != nil {
+		return email.Server{}, err
+	}
+	return email.Server{
+		Host:      host,
+		Port:      conn.Port,
+		Security:  email.Security(conn.Security),
+		TLSConfig: tlsConfig,
+	}, nil
+}
+
+func sendInvites(ctx context.Context, user config.User, calClient *caldav.Client, smtpClient *email.SMTPClient, storage backend.Backend) error {
+	var changes *calendarChanges
 	var err error
 	var data backend.Data
 
-	if events, err = calClient.GetEvents(ctx, time.Now().AddDate(0, 0, -1), time.Now().AddDate(0, 0, eventDays)); err != nil {
-		return fmt.Errorf("failed reading future events: %v", err)
+	username := user.Name
+	if changes, err = readChanges(ctx, user, calClient, storage); err != nil {
+		return err
+	}
+	// Cancellations go first, the invites below record the current attendees of the events
+	if err = sendCancellations(ctx, username, changes, calClient, smtpClient, storage); err != nil {
+		return err
 	}
-	for _, event := range events {
+	if err = sendReplies(ctx, user, changes, calClient, smtpClient, storage); err != nil {
+		return err
+	}
+	for _, event := range changes.invites {
 		if data, err = eventBackendData(ctx, username, event, backend.DirectionOut, storage); err != nil {
 			return fmt.Errorf("failed creating event backend data: %v", err)
 		}
 		if data.Synced || data.Direction != backend.DirectionOut {
 			continue
 		}
-		fmt.Println("sending")
-		fmt.Println(event.Events()[0].Props)
-		if err = smtpClient.SendCalendarInvite(event); err != nil {
-			return fmt.Errorf("failed sending invitation: %v", err)
+		if err = sendEventInvites(ctx, username, event, smtpClient, storage); err != nil {
+			return err
 		}
 		data.Synced = true
 		data.SyncedTime = time.Now()
@@ -119,39 +413,92 @@ func sendInvites(ctx context.Context, username string, eventDays int, calClient
 			return fmt.Errorf("invitations were already sent but failed setting event backend data: %v", err)
 		}
 	}
-	return nil
+	return saveChanges(ctx, username, changes, storage)
 }
 
-func addInvites(ctx context.Context, username string, emailHours int, calClient *caldav.Client, imapClient *email.IMAPClient, storage backend.Backend) error {
-	var events []*ical.Calendar
+func addInvites(ctx context.Context, user config.User, mailbox string, calClient *caldav.Client, imapClient *email.IMAPClient, storage backend.Backend) error {
+	var emails []email.InviteEmail
 	var err error
 	var data backend.Data
+	var mailboxState email.MailboxState
 
-	if events, err = imapClient.ReadCalendarInvites(emailHours); err != nil {
-		return fmt.Errorf("failed reading emails: %v", err)
+	username := user.Name
+	postImport := postImportActions(user.IMAP.PostImport)
+	stateKey := mailboxStateKey(mailbox)
+	if err = backend.GetStateJSON(ctx, storage, username, stateKey, &mailboxState); err != nil {
+		return fmt.Errorf("failed getting mailbox state: %v", err)
+	}
+	if emails, mailboxState, err = imapClient.ReadCalendarInvites(mailbox, mailboxState, user.IMAP.EmailHours, postImport.Keyword); err != nil {
+		return fmt.Errorf("failed reading emails from %s: %v", mailbox, err)
 	}
 
-	for _, event := range events {
-		if data, err = eventBackendData(ctx, username, event, backend.DirectionIn, storage); err != nil {
-			return fmt.Errorf("failed creating event backend data: %v", err)
-		}
-		if data.Synced || data.Direction != backend.DirectionIn {
-			continue
-		}
-		if err := calClient.PutEvent(ctx, event); err != nil {
-			return fmt.Errorf("failed adding event: %v", err)
+	var imported, forOrganizer []uint32
+	for _, inviteEmail := range emails {
+		needsOrganizer := false
+		for _, event := range inviteEmail.Invites {
+			if data, err = eventBackendData(ctx, username, event, backend.DirectionIn, storage); err != nil {
+				return fmt.Errorf("failed creating event backend data: %v", err)
+			}
+			if data.Synced || data.Direction != backend.DirectionIn {
+				continue
+			}
+			err = calClient.PutEvent(ctx, event)
+			switch {
+			case errors.Is(err, caldav.ErrNeedsOrganizer):
+				// The email is left unprocessed and flagged so that the user, the organizer, acts on it
+				log.Printf("not adding invite of user %s, flagging email %d of %s for the organizer: %v", username, inviteEmail.UID, mailbox, err)
+				needsOrganizer = true
+				continue
+			case errors.Is(err, caldav.ErrStale), errors.Is(err, caldav.ErrUnknownEvent):
+				log.Printf("ignoring invite of user %s: %v", username, err)
+			case err != nil:
+				return fmt.Errorf("failed adding event: %v", err)
+			default:
+				if err = recordImportedEvent(ctx, user, event, storage); err != nil {
+					return fmt.Errorf("invitations were already added but failed recording the imported event: %v", err)
+				}
+			}
+			data.Synced = true
+			data.SyncedTime = time.Now()
+			if err = storage.Put(ctx, data); err != nil {
+				return fmt.Errorf("invitations were already added but failed setting event backend data: %v", err)
+			}
 		}
-		fmt.Println("adding")
-		fmt.Println(event.Events()[0].Props)
-		data.Synced = true
-		data.SyncedTime = time.Now()
-		if err = storage.Put(ctx, data); err != nil {
-			return fmt.Errorf("invitations were already added but failed setting event backend data: %v", err)
+		if needsOrganizer {
+			forOrganizer = append(forOrganizer, inviteEmail.UID)
+		} else {
+			imported = append(imported, inviteEmail.UID)
 		}
 	}
+
+	if err = imapClient.FlagForOrganizer(mailbox, forOrganizer); err != nil {
+		return fmt.Errorf("failed flagging the emails for the organizer: %v", err)
+	}
+	if err = imapClient.ApplyPostImportActions(mailbox, imported, postImport); err != nil {
+		return fmt.Errorf("invitations were already added but failed processing their emails: %v", err)
+	}
+
+	// Only remember the read emails once all of their invites were added
+	if err = backend.PutStateJSON(ctx, storage, username, stateKey, mailboxState); err != nil {
+		return fmt.Errorf("invitations were already added but failed setting mailbox state: %v", err)
+	}
 	return nil
 }
 
+func postImportActions(conf config.PostImport) email.PostImportActions {
+	return email.PostImportActions{
+		Keyword:  conf.Keyword,
+		MarkSeen: conf.MarkSeen,
+		MoveTo:   conf.MoveTo,
+		Delete:   conf.Delete,
+	}
+}
+
+// mailboxStateKey returns the backend state key under which the read progress of a mailbox is stored
+func mailboxStateKey(mailbox string) string {
+	return "imap:" + mailbox
+}
+
 func eventBackendData(ctx context.Context, username string, cal *ical.Calendar, direction backend.Direction, storage backend.Backend) (backend.Data, error) {
 	var err error
 	var uid, hash string
@@ -191,21 +538,42 @@ func eventHash(cal *ical.Calendar) (string, error) {
 	dtend, _ := util.EventDTEnd(cal)
 
 	buf.WriteString(uid)
-	for attendee, status := range attendees {
-		buf.WriteString(attendee)
-		buf.WriteString(status)
-	}
+	writeSorted(&buf, attendees)
 	// TODO: I've noticed that when an event is added to my caldav server, the status for organizer becomes `NEEDS_ACTION`
 	// even though it was ACCEPTED in the received event
-	for organizer, status := range organizers {
-		buf.WriteString(organizer)
-		buf.WriteString(status)
-	}
+	writeSorted(&buf, organizers)
 	buf.WriteString(desc)
 	buf.WriteString(summary)
 	buf.WriteString(dtstart.String())
 	buf.WriteString(dtend.String())
+	// The recurrence of the series and the instances an invite is about are only hashed when
+	// present, the hashes of single events stay the same
+	for _, e := range cal.Events() {
+		for _, name := range []string{ical.PropRecurrenceID, ical.PropRecurrenceRule, ical.PropRecurrenceDates, ical.PropExceptionDates} {
+			for _, prop := range e.Props.Values(name) {
+				buf.WriteString(prop.Value)
+			}
+		}
+	}
+	// Calendar objects have no METHOD but invites do, a cancellation is not the same as the request
+	if method := cal.Props.Get(ical.PropMethod); method != nil {
+		buf.WriteString(method.Value)
+	}
 
 	hash.Write(buf.Bytes())
 	return fmt.Sprintf("%x", hash.Sum(nil)), nil
 }
+
+// writeSorted writes the keys and values of m ordered by key, so that the hash of an event does
+// not depend on the random iteration order of maps
+func writeSorted(buf *bytes.Buffer, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		buf.WriteString(key)
+		buf.WriteString(m[key])
+	}
+}
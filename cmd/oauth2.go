@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/nakamorg/calbridge/pkg/backend"
+	"github.com/nakamorg/calbridge/pkg/config"
+	"github.com/nakamorg/calbridge/pkg/oauth2"
+)
+
+// oauth2TokenKeyPrefix holds the refreshed OAuth2 tokens of a service (caldav, smtp or imap)
+const oauth2TokenKeyPrefix = "oauth2:"
+
+// storedToken is a refreshed OAuth2 token. It is kept in the state of the user, which only the
+// owner of the storage can read.
+type storedToken struct {
+	oauth2.Token
+	// SHA-256 of the refresh token of the config the token was obtained from. The stored token is
+	// dropped when the config gets another refresh token. The configured token itself, which
+	// might come from the encrypted secrets, is not stored.
+	Configured string `json:"configured"`
+}
+
+// tokenHash returns the hex encoded SHA-256 of the token
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newTokenSource returns the source of the user's OAuth2 tokens for the service, nil if the service
+// does not use OAuth2
+func newTokenSource(ctx context.Context, username, service string, conf *config.OAuth2, storage backend.Backend) (oauth2.TokenSource, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	switch {
+	case conf.Token != "":
+		return oauth2.StaticTokenSource(conf.Token), nil
+	case conf.Command != "":
+		return oauth2.CommandTokenSource(conf.Command), nil
+	case conf.RefreshToken != "":
+		if conf.TokenURL == "" {
+			return nil, fmt.Errorf("oauth2 of %s has a refresh token but no token URL", service)
+		}
+	default:
+		return nil, fmt.Errorf("oauth2 of %s has no token, refresh token or command", service)
+	}
+
+	key := oauth2TokenKeyPrefix + service
+	var stored storedToken
+	if err := backend.GetStateJSON(ctx, storage, username, key, &stored); err != nil {
+		return nil, fmt.Errorf("failed reading the %s token: %w", service, err)
+	}
+	configured := tokenHash(conf.RefreshToken)
+	token := stored.Token
+	if stored.Configured != configured || token.RefreshToken == "" {
+		token = oauth2.Token{RefreshToken: conf.RefreshToken}
+	}
+	refresh := oauth2.RefreshConfig{
+		TokenURL:     conf.TokenURL,
+		ClientID:     conf.ClientID,
+		ClientSecret: conf.ClientSecret,
+		Scopes:       conf.Scopes,
+	}
+	return oauth2.RefreshTokenSource(refresh, token, func(ctx context.Context, token oauth2.Token) error {
+		return backend.PutStateJSON(ctx, storage, username, key, storedToken{Token: token, Configured: configured})
+	}), nil
+}
+
+// oauth2Mechanism returns the SASL mechanism of the OAuth2 config
+func oauth2Mechanism(conf *config.OAuth2) string {
+	if conf == nil {
+		return ""
+	}
+	return conf.Mechanism
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/nakamorg/calbridge/pkg/backend"
+	"github.com/nakamorg/calbridge/pkg/config"
+)
+
+const (
+	// configEnv is the path of the config file, overridden by the --config flag
+	configEnv = "CALBRIDGE_CONFIG"
+	// dataDirEnv is the directory the data is stored in, overridden by the --data-dir flag
+	dataDirEnv = "CALBRIDGE_DATA_DIR"
+)
+
+// storageFileNames are the names of the storage files in the data directory by storage type
+var storageFileNames = map[string]string{
+	backend.TypeBolt:   "bolt.db",
+	backend.TypeFile:   "data.csv",
+	backend.TypeSQLite: "calbridge.sqlite",
+}
+
+// resolvePaths returns the path of the config file and the data directory, taken from the flags,
+// else from the environment, else ~/.calbridge if it was created by a previous version, else the
+// XDG base directories: $XDG_CONFIG_HOME/calbridge and $XDG_STATE_HOME/calbridge.
+func resolvePaths(configFlag, dataDirFlag string) (string, string, error) {
+	configPath := firstNonEmpty(configFlag, os.Getenv(configEnv))
+	dataDir := firstNonEmpty(dataDirFlag, os.Getenv(dataDirEnv))
+	if configPath != "" && dataDir != "" {
+		return configPath, dataDir, nil
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", "", fmt.Errorf("%w, set the config file with --config and the data directory with --data-dir", err)
+	}
+	configDir := filepath.Join(xdgDir("XDG_CONFIG_HOME", homeDir, ".config"), "calbridge")
+	stateDir := filepath.Join(xdgDir("XDG_STATE_HOME", homeDir, ".local/state"), "calbridge")
+	legacyDir := filepath.Join(homeDir, ".calbridge")
+	if info, err := os.Stat(legacyDir); err == nil && info.IsDir() {
+		configDir, stateDir = legacyDir, legacyDir
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", "", err
+	}
+
+	if configPath == "" {
+		configPath = config.FindConfigFile(configDir)
+	}
+	if dataDir == "" {
+		dataDir = stateDir
+	}
+	return configPath, dataDir, nil
+}
+
+// xdgDir returns the XDG base directory set in env, or its default relative to the home directory.
+// Relative paths are ignored as per the XDG base directory specification.
+func xdgDir(env, homeDir, defaultDir string) string {
+	if dir := os.Getenv(env); filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(homeDir, defaultDir)
+}
+
+// openStorage opens the storage set in the config, a bolt database in dataDir by default. The
+// directory of the storage file is created if needed.
+func openStorage(conf *config.Storage, dataDir string) (backend.Backend, error) {
+	typ := storageType(conf)
+	if typ == backend.TypeMemory {
+		return backend.NewMemoryBackend(), nil
+	}
+
+	var path string
+	if conf != nil {
+		path = conf.Path
+	}
+	path = firstNonEmpty(path, storageFileNames[typ])
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dataDir, path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	return backend.New(typ, path)
+}
+
+// storageType returns the type of the storage set in the config, bolt by default
+func storageType(conf *config.Storage) string {
+	if conf == nil || conf.Type == "" {
+		return backend.TypeBolt
+	}
+	return conf.Type
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
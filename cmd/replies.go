@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/nakamorg/calbridge/pkg/backend"
+	"github.com/nakamorg/calbridge/pkg/caldav"
+	"github.com/nakamorg/calbridge/pkg/config"
+	"github.com/nakamorg/calbridge/pkg/email"
+	"github.com/nakamorg/calbridge/pkg/util"
+)
+
+const importedEventKeyPrefix = "imported:"
+
+// importedEvent is an event, organized by someone else, which was added to the user's calendar
+type importedEvent struct {
+	// Participation status of the user which the organizer knows about
+	PartStat string    `json:"partStat"`
+	End      time.Time `json:"end"`
+	// Participation status of the user in the overridden instances of a recurring event, by
+	// their RECURRENCE-ID
+	Instances map[string]string `json:"instances,omitempty"`
+}
+
+func importedEventKey(uid string) string {
+	return importedEventKeyPrefix + uid
+}
+
+// recordImportedEvent keeps track of the participation status of the user in the invite which was
+// just added to the calendar, so that changes to it can be replied to the organizer. Invites for
+// some instances of a recurring event only update those instances.
+func recordImportedEvent(ctx context.Context, user config.User, cal *ical.Calendar, storage backend.Backend) error {
+	uid, err := util.EventUid(cal)
+	if err != nil {
+		return err
+	}
+	key := importedEventKey(uid)
+	method := caldav.MethodRequest
+	if prop := cal.Props.Get(ical.PropMethod); prop != nil {
+		method = strings.ToUpper(prop.Value)
+	}
+	if method != caldav.MethodRequest && method != caldav.MethodCancel {
+		return nil
+	}
+	if method == caldav.MethodCancel && util.MasterEvent(cal) != nil {
+		return storage.DeleteState(ctx, user.Name, key)
+	}
+
+	var imported importedEvent
+	if err := backend.GetStateJSON(ctx, storage, user.Name, key, &imported); err != nil {
+		return err
+	}
+	if imported.Instances == nil {
+		imported.Instances = map[string]string{}
+	}
+	for _, e := range cal.Events() {
+		id := util.RecurrenceID(e.Component)
+		if method == caldav.MethodCancel {
+			delete(imported.Instances, id)
+			continue
+		}
+		partStat, ok := eventPartStat(e, user.SMTP.Username)
+		if !ok {
+			continue
+		}
+		if id == "" {
+			imported.PartStat = partStat
+		} else {
+			imported.Instances[id] = partStat
+		}
+	}
+	if imported.PartStat == "" && len(imported.Instances) == 0 {
+		return nil
+	}
+
+	end, _ := util.EventDTEnd(cal)
+	if util.MasterEvent(cal) != nil || (!imported.End.IsZero() && imported.End.Before(end)) {
+		imported.End = end
+	}
+	return backend.PutStateJSON(ctx, storage, user.Name, key, imported)
+}
+
+// sendReplies sends a reply to the organizer of every imported event whose participation status
+// was changed by the user
+func sendReplies(ctx context.Context, user config.User, changes *calendarChanges, calClient *caldav.Client, smtpClient *email.SMTPClient, storage backend.Backend) error {
+	records, err := storage.ListState(ctx, user.Name, importedEventKeyPrefix)
+	if err != nil {
+		return fmt.Errorf("failed listing imported events: %v", err)
+	}
+	for key := range records {
+		var imported importedEvent
+		if err := backend.GetStateJSON(ctx, storage, user.Name, key, &imported); err != nil {
+			return fmt.Errorf("failed reading imported event: %v", err)
+		}
+		uid := strings.TrimPrefix(key, importedEventKeyPrefix)
+
+		cal, ok := changes.updated[uid]
+		over := !imported.End.IsZero() && imported.End.Before(time.Now())
+		if !ok && !over && !changes.deleted[uid] {
+			continue
+		}
+		if !ok && !over {
+			// The event might have been moved to another calendar
+			obj, err := calClient.FindEvent(ctx, uid)
+			if err != nil {
+				return fmt.Errorf("failed finding event %s: %v", uid, err)
+			}
+			if obj != nil {
+				cal = obj.Data
+			}
+		}
+		if cal == nil {
+			// The event is over or was removed from the calendar
+			if err := storage.DeleteState(ctx, user.Name, key); err != nil {
+				return fmt.Errorf("failed removing imported event: %v", err)
+			}
+			continue
+		}
+
+		if imported.Instances == nil {
+			imported.Instances = map[string]string{}
+		}
+		var changed []string
+		var updated bool
+		for _, e := range cal.Events() {
+			id := util.RecurrenceID(e.Component)
+			partStat, ok := eventPartStat(e, user.SMTP.Username)
+			if !ok {
+				continue
+			}
+			// Instances which were overridden since have the status of the whole event
+			known, ok := imported.Instances[id]
+			if id == "" || !ok {
+				known = imported.PartStat
+			}
+			if partStat == "" || partStat == known {
+				continue
+			}
+			if partStat != "NEEDS-ACTION" {
+				changed = append(changed, id)
+			}
+			if id == "" {
+				imported.PartStat = partStat
+			} else {
+				imported.Instances[id] = partStat
+			}
+			updated = true
+		}
+		if !updated {
+			continue
+		}
+		if len(changed) != 0 {
+			log.Printf("replying to the organizer of %s", uid)
+			if err := smtpClient.SendCalendarReply(withInstances(cal, changed)); err != nil {
+				return fmt.Errorf("failed sending reply: %v", err)
+			}
+		}
+		if err := backend.PutStateJSON(ctx, storage, user.Name, key, imported); err != nil {
+			return fmt.Errorf("reply was already sent but failed setting imported event: %v", err)
+		}
+	}
+	return nil
+}
+
+// eventPartStat returns the participation status of the attendee with address in the event
+func eventPartStat(e ical.Event, address string) (string, bool) {
+	for _, prop := range e.Props.Values(ical.PropAttendee) {
+		if strings.EqualFold(strings.TrimPrefix(strings.ToLower(prop.Value), "mailto:"), address) {
+			return prop.Params.Get(ical.ParamParticipationStatus), true
+		}
+	}
+	return "", false
+}
+
+// withInstances returns a shallow copy of cal having only the events with the RECURRENCE-IDs in
+// ids, the master event's being empty
+func withInstances(cal *ical.Calendar, ids []string) *ical.Calendar {
+	children := make([]*ical.Component, 0, len(cal.Children))
+	for _, child := range cal.Children {
+		if child.Name != ical.CompEvent || slices.Contains(ids, util.RecurrenceID(child)) {
+			children = append(children, child)
+		}
+	}
+	return &ical.Calendar{Component: &ical.Component{
+		Name:     cal.Name,
+		Props:    cal.Props,
+		Children: children,
+	}}
+}
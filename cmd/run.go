@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/nakamorg/calbridge/pkg/backend"
+	"github.com/nakamorg/calbridge/pkg/config"
+	"github.com/nakamorg/calbridge/pkg/email"
+)
+
+const (
+	// Wait time before retrying a failed sync. It doubles on each consecutive failure
+	// but never exceeds the user's sync frequency.
+	minRetryDelay = time.Minute
+	// How often the mailbox is polled when watching a server that does not support IMAP IDLE
+	idlePollInterval = time.Minute
+	// How often the users are reloaded from the config file and the db
+	reloadInterval = time.Minute
+)
+
+// runDaemon syncs every user on its own schedule, as set by the user's Frequency, until
+// ctx is cancelled. At most concurrency users are synced at the same time. Every reloadInterval
+// the users are reloaded with reload, if they changed: added users are started, removed and
+// disabled ones stopped and changed ones restarted.
+func runDaemon(ctx context.Context, conf config.Config, reload func(context.Context) (config.Config, bool, error), storage backend.Backend) error {
+	intervals, err := userIntervals(conf.Users)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, conf.Concurrency)
+	running := map[string]*runningUser{}
+	start := func(user config.User) {
+		userCtx, cancel := context.WithCancel(ctx)
+		r := &runningUser{user: user, cancel: cancel, done: make(chan struct{})}
+		running[user.Name] = r
+		interval := intervals[user.Name]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(r.done)
+			runUser(userCtx, user, interval, sem, storage)
+		}()
+	}
+	for _, user := range conf.Users {
+		start(user)
+	}
+
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			log.Print("all users stopped, shutting down")
+			return nil
+		case <-ticker.C:
+		}
+
+		newConf, changed, err := reload(ctx)
+		if err == nil && !changed {
+			continue
+		}
+		if err == nil {
+			intervals, err = userIntervals(newConf.Users)
+		}
+		if err != nil {
+			log.Printf("failed reloading the users, keeping the current ones: %v", err)
+			continue
+		}
+		users := map[string]config.User{}
+		for _, user := range newConf.Users {
+			users[user.Name] = user
+		}
+		for name, r := range running {
+			if user, ok := users[name]; ok && reflect.DeepEqual(user, r.user) {
+				delete(users, name)
+				continue
+			}
+			// The user is removed, disabled or changed
+			r.cancel()
+			<-r.done
+			delete(running, name)
+			if _, ok := users[name]; ok {
+				log.Printf("user %s changed, restarting it", name)
+			} else {
+				log.Printf("user %s removed or disabled, stopping it", name)
+			}
+		}
+		for _, user := range users {
+			if _, ok := running[user.Name]; !ok {
+				log.Printf("starting user %s", user.Name)
+			}
+			start(user)
+		}
+	}
+}
+
+// runningUser is a user synced by runDaemon
+type runningUser struct {
+	user   config.User
+	cancel context.CancelFunc
+	// Closed once the user stopped
+	done chan struct{}
+}
+
+// userIntervals returns the sync intervals of the users by name
+func userIntervals(users []config.User) (map[string]time.Duration, error) {
+	intervals := map[string]time.Duration{}
+	for _, user := range users {
+		interval, err := time.ParseDuration(user.Frequency)
+		if err != nil {
+			return nil, fmt.Errorf("invalid frequency %q for user %s: %w", user.Frequency, user.Name, err)
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("invalid frequency %q for user %s: must be positive", user.Frequency, user.Name)
+		}
+		intervals[user.Name] = interval
+	}
+	return intervals, nil
+}
+
+// runUser syncs the user every interval until ctx is cancelled. Failed syncs are logged and
+// retried with backoff. A slot in sem is held for the duration of each sync.
+func runUser(ctx context.Context, user config.User, interval time.Duration, sem chan struct{}, storage backend.Backend) {
+	s := newSession(user, storage)
+	defer s.Close()
+
+	if user.IMAP.Idle {
+		watching := make(chan struct{})
+		go func() {
+			defer close(watching)
+			watchUser(ctx, s, sem)
+		}()
+		// The session must not be closed while the watcher might still use it
+		defer func() { <-watching }()
+	}
+
+	// Spread the first syncs of all the users a bit so that they don't all hit the servers at once
+	timer := time.NewTimer(jitter(interval))
+	defer timer.Stop()
+
+	retryDelay := minRetryDelay
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case sem <- struct{}{}:
+		}
+		err := s.sync(ctx)
+		<-sem
+
+		next := interval + jitter(interval)
+		if err != nil {
+			log.Print(err)
+			next = min(retryDelay, interval)
+			retryDelay *= 2
+		} else {
+			retryDelay = minRetryDelay
+		}
+		timer.Reset(next)
+	}
+}
+
+// watchUser imports the invites of the user as soon as new emails arrive in any of the user's
+// mailboxes. Each mailbox is watched using its own connection.
+func watchUser(ctx context.Context, s *session, sem chan struct{}) {
+	dial := func() (*email.IMAPClient, error) {
+		return newIMAPClient(ctx, s.user, s.storage)
+	}
+
+	var wg sync.WaitGroup
+	for _, mailbox := range s.user.IMAP.MailboxNames() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			email.WatchMailbox(ctx, dial, mailbox, idlePollInterval, func() {
+				select {
+				case <-ctx.Done():
+					return
+				case sem <- struct{}{}:
+				}
+				defer func() { <-sem }()
+				if err := s.importInvites(ctx, mailbox); err != nil {
+					log.Print(err)
+				}
+			})
+		}()
+	}
+	wg.Wait()
+}
+
+// jitter returns a random duration of up to a tenth of the interval
+func jitter(interval time.Duration) time.Duration {
+	return time.Duration(rand.Int64N(int64(interval/10) + 1))
+}
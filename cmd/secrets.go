@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/nakamorg/calbridge/pkg/backend"
+	"github.com/nakamorg/calbridge/pkg/config"
+	"github.com/nakamorg/calbridge/pkg/secrets"
+	"golang.org/x/term"
+)
+
+const (
+	// secretsKeyFileEnv names the key file the secrets are encrypted with
+	secretsKeyFileEnv = "CALBRIDGE_SECRETS_KEY_FILE"
+	// secretsPassphraseEnv holds the passphrase the secrets are encrypted with, asked on the
+	// terminal when neither it nor the key file are set
+	secretsPassphraseEnv = "CALBRIDGE_SECRETS_PASSPHRASE"
+)
+
+const secretsUsage = "usage: calbridge secrets set|get|rm <user> <name>"
+
+// runSecrets runs `calbridge secrets set|get|rm <user> <name>`. set reads the secret from the
+// terminal, or from the standard input when it is not a terminal.
+func runSecrets(ctx context.Context, args []string, storage backend.Backend) error {
+	if len(args) != 3 {
+		return fmt.Errorf(secretsUsage)
+	}
+	action, user, name := args[0], args[1], args[2]
+	switch action {
+	case "set":
+		vault, err := openVault(storage, true)
+		if err != nil {
+			return err
+		}
+		secret, err := readSecret()
+		if err != nil {
+			return err
+		}
+		return vault.Set(ctx, user, name, secret)
+	case "get":
+		vault, err := openVault(storage, false)
+		if err != nil {
+			return err
+		}
+		secret, ok, err := vault.Get(ctx, user, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("user %s has no secret %s", user, name)
+		}
+		fmt.Println(secret)
+		return nil
+	case "rm":
+		store, ok := storage.(backend.SecretStore)
+		if !ok {
+			return fmt.Errorf("the storage does not support secrets")
+		}
+		return store.DeleteSecret(ctx, user, name)
+	}
+	return fmt.Errorf("unknown secrets command %q. %s", action, secretsUsage)
+}
+
+// resolveStoredSecrets replaces the secret:NAME references of the config with the secrets of the vault
+func resolveStoredSecrets(ctx context.Context, conf *config.Config, vault func() (*secrets.Vault, error)) error {
+	return conf.ResolveStoredSecrets(func(user, name string) (string, error) {
+		v, err := vault()
+		if err != nil {
+			return "", err
+		}
+		secret, ok, err := v.Get(ctx, user, name)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", fmt.Errorf("no secret %s, set it with `calbridge secrets set %s %s`", name, user, name)
+		}
+		return secret, nil
+	})
+}
+
+// vaultOpener returns a function opening the vault of the secrets in storage on its first call,
+// so that the passphrase is only asked if there are secrets to read and only once
+func vaultOpener(storage backend.Backend) func() (*secrets.Vault, error) {
+	var mu sync.Mutex
+	var vault *secrets.Vault
+	return func() (*secrets.Vault, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if vault != nil {
+			return vault, nil
+		}
+		v, err := openVault(storage, false)
+		if err != nil {
+			return nil, err
+		}
+		vault = v
+		return vault, nil
+	}
+}
+
+// openVault returns the vault of the secrets in storage, encrypted with the key file or the
+// passphrase of the environment, or else the passphrase typed on the terminal. A typed passphrase
+// is asked twice if confirm is set.
+func openVault(storage backend.Backend, confirm bool) (*secrets.Vault, error) {
+	store, ok := storage.(backend.SecretStore)
+	if !ok {
+		return nil, fmt.Errorf("the storage does not support secrets")
+	}
+	if path := os.Getenv(secretsKeyFileEnv); path != "" {
+		return secrets.NewVaultFromKeyFile(store, path)
+	}
+	if passphrase, ok := os.LookupEnv(secretsPassphraseEnv); ok {
+		return secrets.NewVault(store, passphrase), nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("set %s or %s to read the secrets", secretsKeyFileEnv, secretsPassphraseEnv)
+	}
+
+	passphrase, err := readHidden("Secrets passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	if confirm {
+		repeated, err := readHidden("Repeat the passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if repeated != passphrase {
+			return nil, fmt.Errorf("the passphrases do not match")
+		}
+	}
+	return secrets.NewVault(store, passphrase), nil
+}
+
+// readSecret reads the secret to store from the terminal or the standard input
+func readSecret() (string, error) {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		return readHidden("Secret: ")
+	}
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// readHidden reads a line from the terminal without echoing it
+func readHidden(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return string(line), err
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/nakamorg/calbridge/pkg/backend"
+	"github.com/nakamorg/calbridge/pkg/caldav"
+	"github.com/nakamorg/calbridge/pkg/email"
+	"github.com/nakamorg/calbridge/pkg/util"
+)
+
+const sentEventKeyPrefix = "sent:"
+
+// sentEvent is the last version of an event, organized by the user, whose invites were sent
+type sentEvent struct {
+	Sequence  int       `json:"sequence"`
+	Attendees []string  `json:"attendees"`
+	End       time.Time `json:"end"`
+	// The event as an iCalendar object
+	Event string `json:"event"`
+}
+
+func sentEventKey(uid string) string {
+	return sentEventKeyPrefix + uid
+}
+
+// sendEventInvites sends the invites for the event, which is new or was changed since its invites
+// were last sent. For a new event, the attendees who have not responded yet are invited. For a
+// changed event, the kept attendees get an update listing the changes, with an incremented
+// SEQUENCE, and the new attendees get an invite. The update is also sent when only the attendees
+// changed, as the copy of the kept attendees lists the attendees too.
+func sendEventInvites(ctx context.Context, username string, cal *ical.Calendar, smtpClient *email.SMTPClient, storage backend.Backend) error {
+	if !smtpClient.IsOrganizer(cal) {
+		return nil
+	}
+	uid, err := util.EventUid(cal)
+	if err != nil {
+		return err
+	}
+	var sent sentEvent
+	if err := backend.GetStateJSON(ctx, storage, username, sentEventKey(uid), &sent); err != nil {
+		return fmt.Errorf("failed reading sent event: %v", err)
+	}
+
+	if sent.Event == "" {
+		log.Printf("sending invites for %s", uid)
+		if err := smtpClient.SendCalendarInvite(cal); err != nil {
+			return fmt.Errorf("failed sending invitation: %v", err)
+		}
+	} else {
+		previous, err := ical.NewDecoder(strings.NewReader(sent.Event)).Decode()
+		if err != nil {
+			return fmt.Errorf("failed decoding sent event: %v", err)
+		}
+		changes := eventChanges(previous, cal)
+		if changes.changed() {
+			if util.EventSequence(cal) <= sent.Sequence {
+				setSequence(cal, sent.Sequence+1)
+			}
+			log.Printf("sending updates for %s: %v", uid, changes.describe())
+			if err := smtpClient.SendCalendarUpdate(cal, changes.kept, changes.describe()); err != nil {
+				return fmt.Errorf("failed sending update: %v", err)
+			}
+		}
+		if len(changes.added) != 0 {
+			log.Printf("sending invites for %s to the new attendees %v", uid, changes.added)
+			if err := smtpClient.SendCalendarInviteTo(cal, changes.added); err != nil {
+				return fmt.Errorf("failed sending invitation: %v", err)
+			}
+		}
+	}
+
+	if err := recordSentEvent(ctx, username, uid, sent, cal, storage); err != nil {
+		return fmt.Errorf("invitations were already sent but failed recording the sent event: %v", err)
+	}
+	return nil
+}
+
+// recordSentEvent stores the event whose invites were just sent
+func recordSentEvent(ctx context.Context, username, uid string, sent sentEvent, cal *ical.Calendar, storage backend.Backend) error {
+	var buf bytes.Buffer
+	if err := ical.NewEncoder(&buf).Encode(cal); err != nil {
+		return err
+	}
+	sent.Event = buf.String()
+	sent.Sequence = max(sent.Sequence, util.EventSequence(cal))
+	sent.Attendees = eventAttendees(cal)
+	sent.End, _ = util.EventDTEnd(cal)
+	return backend.PutStateJSON(ctx, storage, username, sentEventKey(uid), sent)
+}
+
+// sendCancellations sends cancellations for the events whose invites were sent before but which
+// were deleted from the calendar since, and to the attendees removed from the changed events
+func sendCancellations(ctx context.Context, username string, changes *calendarChanges, calClient *caldav.Client, smtpClient *email.SMTPClient, storage backend.Backend) error {
+	records, err := storage.ListState(ctx, username, sentEventKeyPrefix)
+	if err != nil {
+		return fmt.Errorf("failed listing sent events: %v", err)
+	}
+	for key := range records {
+		var sent sentEvent
+		if err := backend.GetStateJSON(ctx, storage, username, key, &sent); err != nil {
+			return fmt.Errorf("failed reading sent event: %v", err)
+		}
+		uid := strings.TrimPrefix(key, sentEventKeyPrefix)
+
+		cal, ok := changes.updated[uid]
+		if !ok && !sent.End.IsZero() && sent.End.Before(time.Now()) {
+			// The event is over, there is nothing to cancel anymore
+			if err := storage.DeleteState(ctx, username, key); err != nil {
+				return fmt.Errorf("failed removing sent event: %v", err)
+			}
+			continue
+		}
+		if !ok && !changes.deleted[uid] {
+			continue
+		}
+		if !ok {
+			// The event might have been moved to another calendar
+			obj, err := calClient.FindEvent(ctx, uid)
+			if err != nil {
+				return fmt.Errorf("failed finding event %s: %v", uid, err)
+			}
+			if obj == nil {
+				if err := cancelDeletedEvent(ctx, username, key, sent, smtpClient, storage); err != nil {
+					return err
+				}
+				continue
+			}
+			cal = obj.Data
+		}
+		if !smtpClient.IsOrganizer(cal) {
+			continue
+		}
+
+		attendees := eventAttendees(cal)
+		var removed []string
+		for _, attendee := range sent.Attendees {
+			if !slices.Contains(attendees, attendee) {
+				removed = append(removed, attendee)
+			}
+		}
+		if len(removed) == 0 {
+			continue
+		}
+		sequence := max(sent.Sequence, util.EventSequence(cal)) + 1
+		log.Printf("sending cancellation of %s to the removed attendees %v", uid, removed)
+		if err := smtpClient.SendCalendarCancel(cal, removed, sequence); err != nil {
+			return fmt.Errorf("failed sending cancellation: %v", err)
+		}
+		sent.Sequence = sequence
+		sent.Attendees = attendees
+		if err := backend.PutStateJSON(ctx, storage, username, key, sent); err != nil {
+			return fmt.Errorf("cancellations were already sent but failed setting sent event: %v", err)
+		}
+	}
+	return nil
+}
+
+// cancelDeletedEvent sends a cancellation of the deleted event to all of its attendees
+func cancelDeletedEvent(ctx context.Context, username, key string, sent sentEvent, smtpClient *email.SMTPClient, storage backend.Backend) error {
+	cal, err := ical.NewDecoder(strings.NewReader(sent.Event)).Decode()
+	if err != nil {
+		return fmt.Errorf("failed decoding sent event: %v", err)
+	}
+	log.Printf("sending cancellation of the deleted event %s", strings.TrimPrefix(key, sentEventKeyPrefix))
+	if err := smtpClient.SendCalendarCancel(cal, sent.Attendees, sent.Sequence+1); err != nil {
+		return fmt.Errorf("failed sending cancellation: %v", err)
+	}
+	if err := storage.DeleteState(ctx, username, key); err != nil {
+		return fmt.Errorf("cancellations were already sent but failed removing sent event: %v", err)
+	}
+	return nil
+}
+
+// changes are the differences between two versions of an event
+type changes struct {
+	// Human readable descriptions of the changes to the details of the event
+	fields []string
+	// Attendees added to, removed from and kept in the event
+	added, removed, kept []string
+}
+
+// changed returns whether the details or the attendees of the event changed
+func (c changes) changed() bool {
+	return len(c.fields) != 0 || len(c.added) != 0 || len(c.removed) != 0
+}
+
+func (c changes) describe() []string {
+	described := c.fields
+	if len(c.added) != 0 {
+		described = append(described, "Added attendees: "+strings.Join(c.added, ", "))
+	}
+	if len(c.removed) != 0 {
+		described = append(described, "Removed attendees: "+strings.Join(c.removed, ", "))
+	}
+	return described
+}
+
+// eventChanges returns the changes made to the previous version of the event
+func eventChanges(previous, current *ical.Calendar) changes {
+	var c changes
+	prevStart, prevEnd := firstOccurrence(previous)
+	start, end := firstOccurrence(current)
+	if !prevStart.Equal(start) || !prevEnd.Equal(end) {
+		c.fields = append(c.fields, fmt.Sprintf("Time changed from %s to %s", formatRange(prevStart, prevEnd), formatRange(start, end)))
+	}
+	for _, name := range []string{ical.PropRecurrenceRule, ical.PropRecurrenceDates, ical.PropExceptionDates} {
+		if recurrenceProps(previous, name) != recurrenceProps(current, name) {
+			c.fields = append(c.fields, "Recurrence changed")
+			break
+		}
+	}
+	prevInstances, instances := eventInstances(previous), eventInstances(current)
+	for id, instance := range instances {
+		if prev, ok := prevInstances[id]; !ok || !sameInstance(prev, instance) {
+			c.fields = append(c.fields, "Occurrence on "+instanceDate(instance)+" changed")
+		}
+	}
+	for id, instance := range prevInstances {
+		if _, ok := instances[id]; !ok {
+			c.fields = append(c.fields, "Occurrence on "+instanceDate(instance)+" changed")
+		}
+	}
+	if prev, cur := eventProp(previous, ical.PropSummary), eventProp(current, ical.PropSummary); prev != cur {
+		c.fields = append(c.fields, fmt.Sprintf("Title changed from %q to %q", prev, cur))
+	}
+	if prev, cur := eventProp(previous, ical.PropLocation), eventProp(current, ical.PropLocation); prev != cur {
+		c.fields = append(c.fields, fmt.Sprintf("Location changed from %q to %q", prev, cur))
+	}
+	if eventProp(previous, ical.PropDescription) != eventProp(current, ical.PropDescription) {
+		c.fields = append(c.fields, "Description changed")
+	}
+
+	prevAttendees, attendees := eventAttendees(previous), eventAttendees(current)
+	for _, attendee := range attendees {
+		if slices.Contains(prevAttendees, attendee) {
+			c.kept = append(c.kept, attendee)
+		} else {
+			c.added = append(c.added, attendee)
+		}
+	}
+	for _, attendee := range prevAttendees {
+		if !slices.Contains(attendees, attendee) {
+			c.removed = append(c.removed, attendee)
+		}
+	}
+	return c
+}
+
+// eventProp returns the value of the property of the master event, the changes to the
+// overridden instances are reported separately
+func eventProp(cal *ical.Calendar, name string) string {
+	master := util.MasterEvent(cal)
+	if master == nil {
+		return ""
+	}
+	return instanceProp(*master, name)
+}
+
+// firstOccurrence returns the start and end of the master event, which are those of the first
+// occurrence of a recurring event
+func firstOccurrence(cal *ical.Calendar) (start, end time.Time) {
+	master := util.MasterEvent(cal)
+	if master == nil {
+		start, _ = util.EventDTStart(cal)
+		end, _ = util.EventDTEnd(cal)
+		return start, end
+	}
+	start, _ = master.DateTimeStart(time.UTC)
+	end, _ = master.DateTimeEnd(time.UTC)
+	return start, end
+}
+
+// recurrenceProps returns the values of the recurrence property of the master event
+func recurrenceProps(cal *ical.Calendar, name string) string {
+	master := util.MasterEvent(cal)
+	if master == nil {
+		return ""
+	}
+	var values []string
+	for _, prop := range master.Props.Values(name) {
+		values = append(values, prop.Value)
+	}
+	slices.Sort(values)
+	return strings.Join(values, ",")
+}
+
+// eventInstances returns the overridden instances of a recurring event by their RECURRENCE-ID
+func eventInstances(cal *ical.Calendar) map[string]ical.Event {
+	instances := map[string]ical.Event{}
+	for _, e := range cal.Events() {
+		if id := util.RecurrenceID(e.Component); id != "" {
+			instances[id] = e
+		}
+	}
+	return instances
+}
+
+// sameInstance reports whether the details the attendees care about are the same for both
+// versions of the instance
+func sameInstance(a, b ical.Event) bool {
+	for _, name := range []string{ical.PropDateTimeStart, ical.PropDateTimeEnd, ical.PropDuration, ical.PropSummary,
+		ical.PropLocation, ical.PropDescription, ical.PropStatus} {
+		if instanceProp(a, name) != instanceProp(b, name) {
+			return false
+		}
+	}
+	return true
+}
+
+func instanceProp(e ical.Event, name string) string {
+	if prop := e.Props.Get(name); prop != nil {
+		return prop.Value
+	}
+	return ""
+}
+
+// instanceDate returns the original date of the instance, as given by its RECURRENCE-ID
+func instanceDate(e ical.Event) string {
+	t, err := e.Props.DateTime(ical.PropRecurrenceID, time.UTC)
+	if err != nil {
+		return util.RecurrenceID(e.Component)
+	}
+	return t.UTC().Format("Jan 2, 2006")
+}
+
+// setSequence sets the SEQUENCE of all the events in cal
+func setSequence(cal *ical.Calendar, sequence int) {
+	for _, e := range cal.Events() {
+		e.Props.SetText(ical.PropSequence, strconv.Itoa(sequence))
+	}
+}
+
+func formatRange(start, end time.Time) string {
+	return start.UTC().Format("Jan 2, 2006 15:04") + " - " + end.UTC().Format("Jan 2, 2006 15:04 MST")
+}
+
+// eventAttendees returns the sorted email addresses of the attendees of the event, except for
+// the organizer
+func eventAttendees(cal *ical.Calendar) []string {
+	organizers := util.EventOrganizers(cal)
+	var attendees []string
+	for attendee := range util.EventAttendees(cal) {
+		if _, ok := organizers[attendee]; !ok {
+			attendees = append(attendees, attendee)
+		}
+	}
+	slices.Sort(attendees)
+	return attendees
+}
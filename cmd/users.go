@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/nakamorg/calbridge/pkg/backend"
+	"github.com/nakamorg/calbridge/pkg/config"
+	"github.com/nakamorg/calbridge/pkg/secrets"
+	"golang.org/x/term"
+)
+
+const userUsage = "usage: calbridge user add|show|edit|remove|disable|enable <name> or calbridge user list"
+
+// errNoUsers is returned by userLoader.load when there is neither a config file nor a user in the db
+var errNoUsers = errors.New("no config file and no users")
+
+// userLoader loads the users of the config file and of the db
+type userLoader struct {
+	configPath string
+	storage    backend.Backend
+	vault      func() (*secrets.Vault, error)
+
+	// Fingerprint of the config file and the users of the db at the last load
+	loaded string
+}
+
+// load returns the config with the enabled users of the config file and of the db, a user of the
+// config file taking precedence over the user of the same name in the db
+func (l *userLoader) load(ctx context.Context) (config.Config, error) {
+	fingerprint, err := l.fingerprint(ctx)
+	if err != nil {
+		return config.Config{}, err
+	}
+	conf, err := config.LoadConfig(l.configPath)
+	noConfig := errors.Is(err, os.ErrNotExist)
+	if noConfig {
+		conf = config.Config{Concurrency: config.DefaultConcurrency}
+	} else if err != nil {
+		return conf, err
+	}
+
+	// Storages without users, like the file storage, only have the users of the config file
+	var dbUsers []config.User
+	if store, ok := l.storage.(backend.UserStore); ok {
+		if dbUsers, err = config.LoadUsersFromDB(ctx, store); err != nil {
+			return conf, fmt.Errorf("failed loading the users of the db: %w", err)
+		}
+	}
+	if noConfig && len(dbUsers) == 0 {
+		return conf, errNoUsers
+	}
+	conf.Users = config.EnabledUsers(config.MergeUsers(conf.Users, dbUsers))
+	if err := resolveStoredSecrets(ctx, &conf, l.vault); err != nil {
+		return conf, err
+	}
+	l.loaded = fingerprint
+	return conf, nil
+}
+
+// reload loads the users again if the config file or the users of the db changed since the last
+// load. Secret references are only resolved again when the users are reloaded.
+func (l *userLoader) reload(ctx context.Context) (config.Config, bool, error) {
+	fingerprint, err := l.fingerprint(ctx)
+	if err != nil || fingerprint == l.loaded {
+		return config.Config{}, false, err
+	}
+	conf, err := l.load(ctx)
+	return conf, true, err
+}
+
+// fingerprint returns a hash of the modification time of the config file and of the users of the db
+func (l *userLoader) fingerprint(ctx context.Context) (string, error) {
+	h := sha256.New()
+	if info, err := os.Stat(l.configPath); err == nil {
+		fmt.Fprintf(h, "%d %d\n", info.ModTime().UnixNano(), info.Size())
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	store, ok := l.storage.(backend.UserStore)
+	if !ok {
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	records, err := store.ListUsers(ctx)
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "%q %q\n", name, records[name])
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// runUserCommand runs `calbridge user`. The users of the db are managed, the users of the config
+// file are only listed and shown.
+func runUserCommand(ctx context.Context, args []string, configPath string, storage backend.Backend) error {
+	store, err := userStore(storage)
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 && args[0] == "list" {
+		return listUsers(ctx, configPath, store)
+	}
+	if len(args) != 2 {
+		return fmt.Errorf(userUsage)
+	}
+	action, name := args[0], args[1]
+
+	fileUser, err := configFileUser(configPath, name)
+	if err != nil {
+		return err
+	}
+	if action == "show" && fileUser != nil {
+		return printUser(*fileUser)
+	}
+	if fileUser != nil {
+		return fmt.Errorf("user %s is defined in the config file %s, edit it there", name, configPath)
+	}
+
+	user, err := config.GetUserFromDB(ctx, store, name)
+	if err != nil {
+		return err
+	}
+	if action == "add" {
+		if user != nil {
+			return fmt.Errorf("user %s already exists, use `calbridge user edit %s`", name, name)
+		}
+		added, err := readUser(config.User{Name: name, Frequency: "1h"})
+		if err != nil {
+			return err
+		}
+		return putUser(ctx, store, name, added)
+	}
+	if user == nil {
+		return fmt.Errorf("no user %s", name)
+	}
+
+	switch action {
+	case "show":
+		return printUser(*user)
+	case "edit":
+		edited, err := readUser(*user)
+		if err != nil {
+			return err
+		}
+		return putUser(ctx, store, name, edited)
+	case "remove":
+		return store.DeleteUser(ctx, name)
+	case "disable", "enable":
+		user.Disabled = action == "disable"
+		return config.PutUserToDB(ctx, store, *user)
+	}
+	return fmt.Errorf("unknown user command %q. %s", action, userUsage)
+}
+
+// listUsers prints the users of the config file and of the db
+func listUsers(ctx context.Context, configPath string, store backend.UserStore) error {
+	var fileUsers []config.User
+	if conf, err := config.LoadConfig(configPath); err == nil {
+		fileUsers = conf.Users
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	names := map[string]bool{}
+	for _, user := range fileUsers {
+		names[user.Name] = true
+		fmt.Printf("%s\tconfig file\t%s\n", user.Name, userStatus(user))
+	}
+
+	records, err := store.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	dbNames := make([]string, 0, len(records))
+	for name := range records {
+		dbNames = append(dbNames, name)
+	}
+	sort.Strings(dbNames)
+	for _, name := range dbNames {
+		user, err := config.GetUserFromDB(ctx, store, name)
+		if err != nil {
+			return err
+		}
+		status := userStatus(*user)
+		if names[name] {
+			status = "ignored, the config file has a user of the same name"
+		}
+		fmt.Printf("%s\tdb\t%s\n", name, status)
+	}
+	return nil
+}
+
+func userStatus(user config.User) string {
+	if user.Disabled {
+		return "disabled"
+	}
+	return "every " + user.Frequency
+}
+
+// configFileUser returns the user named name of the config file, nil if there is none
+func configFileUser(configPath, name string) (*config.User, error) {
+	users, err := config.LoadUsersFromConfig(configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if user.Name == name {
+			return &user, nil
+		}
+	}
+	return nil, nil
+}
+
+// putUser stores the user, after checking its name and validating it
+func putUser(ctx context.Context, store backend.UserStore, name string, user config.User) error {
+	if user.Name != name {
+		return fmt.Errorf("the user can not be renamed, remove it and add %s instead", user.Name)
+	}
+	if problems := user.Validate(); len(problems) > 0 {
+		return &config.Error{File: "user " + name, Problems: problems}
+	}
+	if names := user.PlainSecrets(); len(names) > 0 {
+		fmt.Fprintf(os.Stderr, "the %s of user %s is stored unencrypted, store it with `calbridge secrets set` and reference it as secret:NAME instead\n",
+			strings.Join(names, ", "), name)
+	}
+	return config.PutUserToDB(ctx, store, user)
+}
+
+// printUser prints the user in json, with its secrets masked
+func printUser(user config.User) error {
+	data, err := json.MarshalIndent(user.WithoutSecrets(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// readUser reads the user in json from the standard input or, on a terminal, lets the user edit
+// it in $EDITOR starting from user
+func readUser(user config.User) (config.User, error) {
+	var data []byte
+	var err error
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		data, err = editUser(user)
+	} else {
+		data, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return user, err
+	}
+
+	var read config.User
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&read); err != nil {
+		return user, fmt.Errorf("invalid user: %w", err)
+	}
+	if read.Name == "" {
+		read.Name = user.Name
+	}
+	return read, nil
+}
+
+// editUser opens the user in json in $EDITOR and returns the edited json
+func editUser(user config.User) ([]byte, error) {
+	data, err := json.MarshalIndent(user, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp("", "calbridge-user-*.json")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", file.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("editor failed: %w", err)
+	}
+	return os.ReadFile(file.Name())
+}
+
+// userStore returns the storage as a UserStore
+func userStore(storage backend.Backend) (backend.UserStore, error) {
+	store, ok := storage.(backend.UserStore)
+	if !ok {
+		return nil, fmt.Errorf("the storage does not support users")
+	}
+	return store, nil
+}
@@ -3,17 +3,22 @@ module github.com/nakamorg/calbridge
 go 1.22.5
 
 require (
+	github.com/BurntSushi/toml v1.5.0
 	github.com/emersion/go-ical v0.0.0-20240127095438-fc1c9d8fb2b6
 	github.com/emersion/go-imap v1.2.1
 	github.com/emersion/go-message v0.18.1
 	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21
 	github.com/emersion/go-smtp v0.21.3
 	github.com/emersion/go-webdav v0.5.0
+	github.com/mattn/go-sqlite3 v1.14.22
+	github.com/teambition/rrule-go v1.8.2
 	go.etcd.io/bbolt v1.3.11
+	golang.org/x/crypto v0.24.0
+	golang.org/x/term v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/teambition/rrule-go v1.8.2 // indirect
-	golang.org/x/sys v0.5.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
 )
@@ -2,6 +2,8 @@ package backend
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"time"
 )
 
@@ -21,12 +23,89 @@ type Data struct {
 	Synced     bool      `json:"synced"`
 }
 
+// Backend stores the sync state of events. Implementations must be safe for concurrent use
+// as users are synced in parallel.
 type Backend interface {
 	Get(ctx context.Context, data Data) (Data, error)
 	Put(ctx context.Context, data Data) error
+	// GetState returns the state stored for the user under key or nil if there is none.
+	// State holds small pieces of sync progress like the last read email of a mailbox.
+	GetState(ctx context.Context, user, key string) ([]byte, error)
+	// PutState stores the state for the user under key, replacing any previous value
+	PutState(ctx context.Context, user, key string, value []byte) error
+	// ListState returns all the states of the user whose keys start with prefix
+	ListState(ctx context.Context, user, prefix string) (map[string][]byte, error)
+	// DeleteState removes the state stored for the user under key
+	DeleteState(ctx context.Context, user, key string) error
 	Close() error
 }
 
+// SecretStore stores secrets of the users, like passwords. The store keeps the secrets as given,
+// they are encrypted beforehand.
+type SecretStore interface {
+	// GetSecret returns the secret of the user named name or nil if there is none
+	GetSecret(ctx context.Context, user, name string) ([]byte, error)
+	// PutSecret stores the secret of the user named name, replacing any previous value
+	PutSecret(ctx context.Context, user, name string, value []byte) error
+	// DeleteSecret removes the secret of the user named name
+	DeleteSecret(ctx context.Context, user, name string) error
+}
+
+// UserStore stores the config of the users managed with `calbridge user`, as given
+type UserStore interface {
+	// GetUser returns the config of the user named name or nil if there is none
+	GetUser(ctx context.Context, name string) ([]byte, error)
+	// PutUser stores the config of the user named name, replacing any previous value
+	PutUser(ctx context.Context, name string, user []byte) error
+	// ListUsers returns the configs of all the stored users by their name
+	ListUsers(ctx context.Context) (map[string][]byte, error)
+	// DeleteUser removes the config of the user named name. The data of the user is kept.
+	DeleteUser(ctx context.Context, name string) error
+}
+
+// Types of the backends
+const (
+	TypeBolt   = "bolt"
+	TypeFile   = "file"
+	TypeSQLite = "sqlite"
+	TypeMemory = "memory"
+)
+
+// New returns the backend of type typ storing its data at path. The memory backend ignores path.
+// Only the bolt, sqlite and memory backends store users and secrets.
+func New(typ, path string) (Backend, error) {
+	switch typ {
+	case TypeBolt:
+		return NewBoltBackend(path)
+	case TypeFile:
+		return NewFileBackend(path), nil
+	case TypeSQLite:
+		return newSQLiteBackend(path)
+	case TypeMemory:
+		return NewMemoryBackend(), nil
+	}
+	return nil, fmt.Errorf("unknown storage type %q, use %s, %s, %s or %s", typ, TypeBolt, TypeFile, TypeSQLite, TypeMemory)
+}
+
+// GetStateJSON reads the state stored for the user under key into v. v is left untouched if
+// there is no state.
+func GetStateJSON(ctx context.Context, b Backend, user, key string, v any) error {
+	value, err := b.GetState(ctx, user, key)
+	if err != nil || value == nil {
+		return err
+	}
+	return json.Unmarshal(value, v)
+}
+
+// PutStateJSON stores v, encoded as json, as the state of the user under key
+func PutStateJSON(ctx context.Context, b Backend, user, key string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.PutState(ctx, user, key, value)
+}
+
 type DummyBackend struct{}
 
 // NewDummyBackend returns a Backend. This backend does not store any data and always returns
@@ -43,6 +122,22 @@ func (b *DummyBackend) Put(ctx context.Context, data Data) error {
 	return nil
 }
 
+func (b *DummyBackend) GetState(ctx context.Context, user, key string) ([]byte, error) {
+	return nil, nil
+}
+
+func (b *DummyBackend) PutState(ctx context.Context, user, key string, value []byte) error {
+	return nil
+}
+
+func (b *DummyBackend) ListState(ctx context.Context, user, prefix string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func (b *DummyBackend) DeleteState(ctx context.Context, user, key string) error {
+	return nil
+}
+
 func (b *DummyBackend) Close() error {
 	return nil
 }
@@ -1,28 +1,120 @@
 package backend
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
 
+// stateBucket and secretsBucket are nested in the bucket of each user, which also holds the
+// config of the user under userKey. Their names can not clash with the data keys as those always
+// contain a ":"
+var (
+	stateBucket   = []byte("state")
+	secretsBucket = []byte("secrets")
+	userKey       = []byte("config")
+)
+
+const (
+	// boltLockTimeout is how long to wait for the database while another process uses it
+	boltLockTimeout = 30 * time.Second
+	// boltIdleTimeout is how long the database is kept open once it is no longer used. Closing it
+	// releases its file lock so that other processes, like `calbridge user`, can use it.
+	boltIdleTimeout = time.Second
+)
+
 type BoltBackend struct {
+	path string
+
+	mu sync.Mutex
 	db *bolt.DB
+	// Number of transactions in progress
+	inUse     int
+	idleTimer *time.Timer
 }
 
+// NewBoltBackend returns a Backend which stores the data in a bolt database at dbPath. Bolt
+// serializes the write transactions so the backend is safe for concurrent use. The database is
+// only kept open while it is used, so that several processes can share it.
 func NewBoltBackend(dbPath string) (Backend, error) {
-	db, err := bolt.Open(dbPath, 0600, nil)
-	if err != nil {
+	bb := &BoltBackend{path: dbPath}
+	// Fail early if the database can not be opened
+	if _, err := bb.acquire(); err != nil {
 		return nil, err
 	}
+	bb.release()
+	return bb, nil
+}
+
+// view runs fn in a read-only transaction
+func (bb *BoltBackend) view(fn func(tx *bolt.Tx) error) error {
+	db, err := bb.acquire()
+	if err != nil {
+		return err
+	}
+	defer bb.release()
+	return db.View(fn)
+}
 
-	return &BoltBackend{db: db}, nil
+// update runs fn in a read-write transaction
+func (bb *BoltBackend) update(fn func(tx *bolt.Tx) error) error {
+	db, err := bb.acquire()
+	if err != nil {
+		return err
+	}
+	defer bb.release()
+	return db.Update(fn)
+}
+
+// acquire opens the database if needed and keeps it open until the matching release
+func (bb *BoltBackend) acquire() (*bolt.DB, error) {
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+	if bb.idleTimer != nil {
+		bb.idleTimer.Stop()
+		bb.idleTimer = nil
+	}
+	if bb.db == nil {
+		db, err := bolt.Open(bb.path, 0600, &bolt.Options{Timeout: boltLockTimeout})
+		if errors.Is(err, bolt.ErrTimeout) {
+			return nil, fmt.Errorf("database %s is in use by another process: %w", bb.path, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		bb.db = db
+	}
+	bb.inUse++
+	return bb.db, nil
+}
+
+// release closes the database once it is no longer used for boltIdleTimeout
+func (bb *BoltBackend) release() {
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+	bb.inUse--
+	if bb.inUse > 0 {
+		return
+	}
+	bb.idleTimer = time.AfterFunc(boltIdleTimeout, func() {
+		bb.mu.Lock()
+		defer bb.mu.Unlock()
+		if bb.inUse == 0 && bb.db != nil {
+			bb.db.Close()
+			bb.db = nil
+		}
+	})
 }
 
 func (bb *BoltBackend) Get(ctx context.Context, data Data) (Data, error) {
 	key := bb.key(data)
-	err := bb.db.View(func(tx *bolt.Tx) error {
+	err := bb.view(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(data.User))
 		if b == nil {
 			return nil
@@ -43,7 +135,7 @@ func (bb *BoltBackend) Get(ctx context.Context, data Data) (Data, error) {
 
 func (bb *BoltBackend) Put(ctx context.Context, data Data) error {
 	key := bb.key(data)
-	return bb.db.Update(func(tx *bolt.Tx) error {
+	return bb.update(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucketIfNotExists([]byte(data.User))
 		if err != nil {
 			return err
@@ -58,11 +150,187 @@ func (bb *BoltBackend) Put(ctx context.Context, data Data) error {
 	})
 }
 
+func (bb *BoltBackend) GetState(ctx context.Context, user, key string) ([]byte, error) {
+	var value []byte
+	err := bb.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(user))
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket(stateBucket)
+		if b == nil {
+			return nil
+		}
+
+		// The value is only valid during the transaction so we need to copy it
+		if v := b.Get([]byte(key)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (bb *BoltBackend) PutState(ctx context.Context, user, key string, value []byte) error {
+	return bb.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(user))
+		if err != nil {
+			return err
+		}
+		b, err = b.CreateBucketIfNotExists(stateBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+func (bb *BoltBackend) ListState(ctx context.Context, user, prefix string) (map[string][]byte, error) {
+	states := map[string][]byte{}
+	err := bb.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(user))
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket(stateBucket)
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			states[string(k)] = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return states, err
+}
+
+func (bb *BoltBackend) DeleteState(ctx context.Context, user, key string) error {
+	return bb.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(user))
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket(stateBucket)
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func (bb *BoltBackend) GetSecret(ctx context.Context, user, name string) ([]byte, error) {
+	var value []byte
+	err := bb.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(user))
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket(secretsBucket)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(name)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (bb *BoltBackend) PutSecret(ctx context.Context, user, name string, value []byte) error {
+	return bb.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(user))
+		if err != nil {
+			return err
+		}
+		b, err = b.CreateBucketIfNotExists(secretsBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), value)
+	})
+}
+
+func (bb *BoltBackend) DeleteSecret(ctx context.Context, user, name string) error {
+	return bb.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(user))
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket(secretsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(name))
+	})
+}
+
+func (bb *BoltBackend) GetUser(ctx context.Context, name string) ([]byte, error) {
+	var value []byte
+	err := bb.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get(userKey); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (bb *BoltBackend) PutUser(ctx context.Context, name string, user []byte) error {
+	return bb.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		return b.Put(userKey, user)
+	})
+}
+
+func (bb *BoltBackend) ListUsers(ctx context.Context) (map[string][]byte, error) {
+	users := map[string][]byte{}
+	err := bb.view(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if v := b.Get(userKey); v != nil {
+				users[string(name)] = append([]byte{}, v...)
+			}
+			return nil
+		})
+	})
+	return users, err
+}
+
+func (bb *BoltBackend) DeleteUser(ctx context.Context, name string) error {
+	return bb.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+		return b.Delete(userKey)
+	})
+}
+
 func (bb *BoltBackend) key(data Data) []byte {
 	// Create a composite key combining data.UID and data.Hash with a delimiter
 	return []byte(data.UID + ":" + data.Hash)
 }
 
 func (bb *BoltBackend) Close() error {
-	return bb.db.Close()
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+	if bb.idleTimer != nil {
+		bb.idleTimer.Stop()
+		bb.idleTimer = nil
+	}
+	if bb.db == nil {
+		return nil
+	}
+	err := bb.db.Close()
+	bb.db = nil
+	return err
 }
@@ -3,7 +3,10 @@ package backend
 import (
 	"context"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -13,6 +16,8 @@ type FileBackend struct {
 	filePath string
 }
 
+// NewFileBackend returns a Backend which appends the data as csv records to the file at filePath.
+// Access to the file is guarded by a lock so the backend is safe for concurrent use.
 func NewFileBackend(filePath string) Backend {
 	return &FileBackend{filePath: filePath}
 }
@@ -21,7 +26,7 @@ func (fb *FileBackend) Get(ctx context.Context, data Data) (Data, error) {
 	fb.mu.RLock()
 	defer fb.mu.RUnlock()
 
-	file, err := os.OpenFile(fb.filePath, os.O_RDWR|os.O_CREATE, 0644)
+	file, err := os.OpenFile(fb.filePath, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
 		return data, err
 	}
@@ -49,7 +54,7 @@ func (fb *FileBackend) Put(ctx context.Context, data Data) error {
 	fb.mu.Lock()
 	defer fb.mu.Unlock()
 
-	file, err := os.OpenFile(fb.filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	file, err := os.OpenFile(fb.filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
 		return err
 	}
@@ -75,6 +80,92 @@ func (fb *FileBackend) Put(ctx context.Context, data Data) error {
 	return writer.Error()
 }
 
+// GetState reads the state from a json file next to the csv file
+func (fb *FileBackend) GetState(ctx context.Context, user, key string) ([]byte, error) {
+	fb.mu.RLock()
+	defer fb.mu.RUnlock()
+
+	states, err := fb.readStates()
+	if err != nil {
+		return nil, err
+	}
+	return states[user][key], nil
+}
+
+// PutState rewrites the json state file with the new value
+func (fb *FileBackend) PutState(ctx context.Context, user, key string, value []byte) error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	states, err := fb.readStates()
+	if err != nil {
+		return err
+	}
+	if states[user] == nil {
+		states[user] = map[string][]byte{}
+	}
+	states[user][key] = value
+	return fb.writeStates(states)
+}
+
+func (fb *FileBackend) ListState(ctx context.Context, user, prefix string) (map[string][]byte, error) {
+	fb.mu.RLock()
+	defer fb.mu.RUnlock()
+
+	states, err := fb.readStates()
+	if err != nil {
+		return nil, err
+	}
+	matching := map[string][]byte{}
+	for key, value := range states[user] {
+		if strings.HasPrefix(key, prefix) {
+			matching[key] = value
+		}
+	}
+	return matching, nil
+}
+
+func (fb *FileBackend) DeleteState(ctx context.Context, user, key string) error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	states, err := fb.readStates()
+	if err != nil {
+		return err
+	}
+	delete(states[user], key)
+	return fb.writeStates(states)
+}
+
+func (fb *FileBackend) writeStates(states map[string]map[string][]byte) error {
+	data, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	// The states hold OAuth2 tokens, only the owner may read them. WriteFile keeps the mode of an
+	// existing file, the files of previous versions were readable by everyone.
+	if err := os.WriteFile(fb.stateFilePath(), data, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(fb.stateFilePath(), 0600)
+}
+
+func (fb *FileBackend) readStates() (map[string]map[string][]byte, error) {
+	states := map[string]map[string][]byte{}
+	data, err := os.ReadFile(fb.stateFilePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return states, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &states)
+	return states, err
+}
+
+func (fb *FileBackend) stateFilePath() string {
+	return fb.filePath + ".state.json"
+}
+
 func (fb *FileBackend) Close() error {
 	return nil
 }
@@ -0,0 +1,148 @@
+package backend
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+type MemoryBackend struct {
+	mu sync.RWMutex
+	// Data of the users by user and key
+	data    map[string]map[string]Data
+	states  map[string]map[string][]byte
+	secrets map[string]map[string][]byte
+	users   map[string][]byte
+}
+
+// NewMemoryBackend returns a Backend which keeps the data in memory, it is lost once the process
+// exits. It is meant for dry runs and tests.
+func NewMemoryBackend() Backend {
+	return &MemoryBackend{
+		data:    map[string]map[string]Data{},
+		states:  map[string]map[string][]byte{},
+		secrets: map[string]map[string][]byte{},
+		users:   map[string][]byte{},
+	}
+}
+
+func (mb *MemoryBackend) Get(ctx context.Context, data Data) (Data, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	if stored, ok := mb.data[data.User][data.UID+":"+data.Hash]; ok {
+		return stored, nil
+	}
+	return data, nil
+}
+
+func (mb *MemoryBackend) Put(ctx context.Context, data Data) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.data[data.User] == nil {
+		mb.data[data.User] = map[string]Data{}
+	}
+	mb.data[data.User][data.UID+":"+data.Hash] = data
+	return nil
+}
+
+func (mb *MemoryBackend) GetState(ctx context.Context, user, key string) ([]byte, error) {
+	return mb.get(mb.states, user, key), nil
+}
+
+func (mb *MemoryBackend) PutState(ctx context.Context, user, key string, value []byte) error {
+	mb.put(mb.states, user, key, value)
+	return nil
+}
+
+func (mb *MemoryBackend) ListState(ctx context.Context, user, prefix string) (map[string][]byte, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	states := map[string][]byte{}
+	for key, value := range mb.states[user] {
+		if strings.HasPrefix(key, prefix) {
+			states[key] = append([]byte{}, value...)
+		}
+	}
+	return states, nil
+}
+
+func (mb *MemoryBackend) DeleteState(ctx context.Context, user, key string) error {
+	mb.delete(mb.states, user, key)
+	return nil
+}
+
+func (mb *MemoryBackend) GetSecret(ctx context.Context, user, name string) ([]byte, error) {
+	return mb.get(mb.secrets, user, name), nil
+}
+
+func (mb *MemoryBackend) PutSecret(ctx context.Context, user, name string, value []byte) error {
+	mb.put(mb.secrets, user, name, value)
+	return nil
+}
+
+func (mb *MemoryBackend) DeleteSecret(ctx context.Context, user, name string) error {
+	mb.delete(mb.secrets, user, name)
+	return nil
+}
+
+func (mb *MemoryBackend) GetUser(ctx context.Context, name string) ([]byte, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	if user, ok := mb.users[name]; ok {
+		return append([]byte{}, user...), nil
+	}
+	return nil, nil
+}
+
+func (mb *MemoryBackend) PutUser(ctx context.Context, name string, user []byte) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.users[name] = append([]byte{}, user...)
+	return nil
+}
+
+func (mb *MemoryBackend) ListUsers(ctx context.Context) (map[string][]byte, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	users := map[string][]byte{}
+	for name, user := range mb.users {
+		users[name] = append([]byte{}, user...)
+	}
+	return users, nil
+}
+
+func (mb *MemoryBackend) DeleteUser(ctx context.Context, name string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	delete(mb.users, name)
+	return nil
+}
+
+// get returns a copy of the value of the user under key in values, nil if there is none
+func (mb *MemoryBackend) get(values map[string]map[string][]byte, user, key string) []byte {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	if value, ok := values[user][key]; ok {
+		return append([]byte{}, value...)
+	}
+	return nil
+}
+
+func (mb *MemoryBackend) put(values map[string]map[string][]byte, user, key string, value []byte) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if values[user] == nil {
+		values[user] = map[string][]byte{}
+	}
+	values[user][key] = append([]byte{}, value...)
+}
+
+func (mb *MemoryBackend) delete(values map[string]map[string][]byte, user, key string) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	delete(values[user], key)
+}
+
+func (mb *MemoryBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,162 @@
+//go:build sqlite
+
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS data (user TEXT, uid TEXT, hash TEXT, value BLOB, PRIMARY KEY (user, uid, hash));
+CREATE TABLE IF NOT EXISTS state (user TEXT, key TEXT, value BLOB, PRIMARY KEY (user, key));
+CREATE TABLE IF NOT EXISTS secrets (user TEXT, name TEXT, value BLOB, PRIMARY KEY (user, name));
+CREATE TABLE IF NOT EXISTS users (name TEXT PRIMARY KEY, config BLOB);
+`
+
+type SQLiteBackend struct {
+	db *sql.DB
+}
+
+// newSQLiteBackend returns a Backend which stores the data in a sqlite database at dbPath. The
+// database is in WAL mode and waits for the locks of other processes, so that several processes
+// can share it.
+func newSQLiteBackend(dbPath string) (Backend, error) {
+	// The database holds the users and the secrets, only the owner may read it. sqlite creates the
+	// WAL files with the permissions of the database.
+	file, err := os.OpenFile(dbPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=%d&_journal_mode=WAL", dbPath, boltLockTimeout.Milliseconds()))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed creating the tables of %s: %w", dbPath, err)
+	}
+	return &SQLiteBackend{db: db}, nil
+}
+
+func (sb *SQLiteBackend) Get(ctx context.Context, data Data) (Data, error) {
+	var value []byte
+	err := sb.db.QueryRowContext(ctx, "SELECT value FROM data WHERE user = ? AND uid = ? AND hash = ?",
+		data.User, data.UID, data.Hash).Scan(&value)
+	if err == sql.ErrNoRows {
+		return data, nil
+	}
+	if err != nil {
+		return data, err
+	}
+	err = json.Unmarshal(value, &data)
+	return data, err
+}
+
+func (sb *SQLiteBackend) Put(ctx context.Context, data Data) error {
+	value, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = sb.db.ExecContext(ctx, `INSERT INTO data (user, uid, hash, value) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user, uid, hash) DO UPDATE SET value = excluded.value`, data.User, data.UID, data.Hash, value)
+	return err
+}
+
+func (sb *SQLiteBackend) GetState(ctx context.Context, user, key string) ([]byte, error) {
+	return sb.get(ctx, "SELECT value FROM state WHERE user = ? AND key = ?", user, key)
+}
+
+func (sb *SQLiteBackend) PutState(ctx context.Context, user, key string, value []byte) error {
+	_, err := sb.db.ExecContext(ctx, `INSERT INTO state (user, key, value) VALUES (?, ?, ?)
+		ON CONFLICT (user, key) DO UPDATE SET value = excluded.value`, user, key, value)
+	return err
+}
+
+func (sb *SQLiteBackend) ListState(ctx context.Context, user, prefix string) (map[string][]byte, error) {
+	rows, err := sb.db.QueryContext(ctx, "SELECT key, value FROM state WHERE user = ? AND substr(key, 1, length(?)) = ?",
+		user, prefix, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return scanValues(rows)
+}
+
+func (sb *SQLiteBackend) DeleteState(ctx context.Context, user, key string) error {
+	_, err := sb.db.ExecContext(ctx, "DELETE FROM state WHERE user = ? AND key = ?", user, key)
+	return err
+}
+
+func (sb *SQLiteBackend) GetSecret(ctx context.Context, user, name string) ([]byte, error) {
+	return sb.get(ctx, "SELECT value FROM secrets WHERE user = ? AND name = ?", user, name)
+}
+
+func (sb *SQLiteBackend) PutSecret(ctx context.Context, user, name string, value []byte) error {
+	_, err := sb.db.ExecContext(ctx, `INSERT INTO secrets (user, name, value) VALUES (?, ?, ?)
+		ON CONFLICT (user, name) DO UPDATE SET value = excluded.value`, user, name, value)
+	return err
+}
+
+func (sb *SQLiteBackend) DeleteSecret(ctx context.Context, user, name string) error {
+	_, err := sb.db.ExecContext(ctx, "DELETE FROM secrets WHERE user = ? AND name = ?", user, name)
+	return err
+}
+
+func (sb *SQLiteBackend) GetUser(ctx context.Context, name string) ([]byte, error) {
+	return sb.get(ctx, "SELECT config FROM users WHERE name = ?", name)
+}
+
+func (sb *SQLiteBackend) PutUser(ctx context.Context, name string, user []byte) error {
+	_, err := sb.db.ExecContext(ctx, `INSERT INTO users (name, config) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET config = excluded.config`, name, user)
+	return err
+}
+
+func (sb *SQLiteBackend) ListUsers(ctx context.Context) (map[string][]byte, error) {
+	rows, err := sb.db.QueryContext(ctx, "SELECT name, config FROM users")
+	if err != nil {
+		return nil, err
+	}
+	return scanValues(rows)
+}
+
+func (sb *SQLiteBackend) DeleteUser(ctx context.Context, name string) error {
+	_, err := sb.db.ExecContext(ctx, "DELETE FROM users WHERE name = ?", name)
+	return err
+}
+
+// get returns the value selected by query, nil if there is none
+func (sb *SQLiteBackend) get(ctx context.Context, query string, args ...any) ([]byte, error) {
+	var value []byte
+	err := sb.db.QueryRowContext(ctx, query, args...).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return value, err
+}
+
+// scanValues returns the values of the rows by their key, the rows having a key and a value column
+func scanValues(rows *sql.Rows) (map[string][]byte, error) {
+	defer rows.Close()
+	values := map[string][]byte{}
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, rows.Err()
+}
+
+func (sb *SQLiteBackend) Close() error {
+	return sb.db.Close()
+}
@@ -0,0 +1,10 @@
+//go:build !sqlite
+
+package backend
+
+import "fmt"
+
+// newSQLiteBackend fails as the sqlite backend needs cgo, which the release builds are built without
+func newSQLiteBackend(dbPath string) (Backend, error) {
+	return nil, fmt.Errorf("calbridge was built without sqlite support, build it with `CGO_ENABLED=1 go build -tags sqlite ./cmd`")
+}
@@ -0,0 +1,132 @@
+package caldav
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav/caldav"
+)
+
+// SetCalendars selects the calendars the client works with. Events are read from the calendars
+// in scan, or from all the calendars if scan is empty, and imported invites are written to
+// importCalendar, or to the first of the scanned calendars if it is empty. Calendars are given by
+// their display name or their path, absolute or relative to the client's URL.
+func (c *Client) SetCalendars(scan []string, importCalendar string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scan = scan
+	c.importCalendar = importCalendar
+	c.importPath = ""
+}
+
+// scannedCalendars returns the calendars events are read from
+func (c *Client) scannedCalendars(ctx context.Context) ([]caldav.Calendar, error) {
+	calendars, err := c.findEventCalendars(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	scan := c.scan
+	c.mu.Unlock()
+	if len(scan) == 0 {
+		if len(calendars) == 0 {
+			return nil, fmt.Errorf("no calendars found")
+		}
+		return calendars, nil
+	}
+
+	var selected []caldav.Calendar
+	for _, name := range scan {
+		calendar, ok := c.matchCalendar(calendars, name)
+		if !ok {
+			return nil, fmt.Errorf("calendar %q not found", name)
+		}
+		selected = append(selected, calendar)
+	}
+	return selected, nil
+}
+
+// importCalendarPath returns the path of the calendar imported invites are written to
+func (c *Client) importCalendarPath(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	path, name := c.importPath, c.importCalendar
+	c.mu.Unlock()
+	if path != "" {
+		return path, nil
+	}
+
+	if name == "" {
+		calendars, err := c.scannedCalendars(ctx)
+		if err != nil {
+			return "", err
+		}
+		path = calendars[0].Path
+	} else {
+		calendars, err := c.findEventCalendars(ctx)
+		if err != nil {
+			return "", err
+		}
+		calendar, ok := c.matchCalendar(calendars, name)
+		if !ok {
+			return "", fmt.Errorf("import calendar %q not found", name)
+		}
+		path = calendar.Path
+	}
+
+	c.mu.Lock()
+	c.importPath = path
+	c.mu.Unlock()
+	return path, nil
+}
+
+// searchedCalendars returns the paths of the scanned calendars and of the import calendar, where
+// events are looked up by their UID
+func (c *Client) searchedCalendars(ctx context.Context) ([]string, error) {
+	calendars, err := c.scannedCalendars(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, calendar := range calendars {
+		paths = append(paths, calendar.Path)
+	}
+	importPath, err := c.importCalendarPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(paths, importPath) {
+		paths = append(paths, importPath)
+	}
+	return paths, nil
+}
+
+// findEventCalendars returns the calendars which can hold events
+func (c *Client) findEventCalendars(ctx context.Context) ([]caldav.Calendar, error) {
+	calendars, err := c.c.FindCalendars(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	var eventCalendars []caldav.Calendar
+	for _, calendar := range calendars {
+		// Servers not advertising the supported components accept all of them
+		if len(calendar.SupportedComponentSet) == 0 || slices.Contains(calendar.SupportedComponentSet, ical.CompEvent) {
+			eventCalendars = append(eventCalendars, calendar)
+		}
+	}
+	return eventCalendars, nil
+}
+
+// matchCalendar returns the calendar whose display name or path is name
+func (c *Client) matchCalendar(calendars []caldav.Calendar, name string) (caldav.Calendar, bool) {
+	path := strings.TrimSuffix(c.endpoint.ResolveReference(&url.URL{Path: name}).Path, "/")
+	for _, calendar := range calendars {
+		if calendar.Name == name || strings.TrimSuffix(calendar.Path, "/") == path {
+			return calendar, true
+		}
+	}
+	return caldav.Calendar{}, false
+}
@@ -1,39 +1,84 @@
 package caldav
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	nethttp "net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-ical"
 	"github.com/emersion/go-webdav/caldav"
 	"github.com/nakamorg/calbridge/pkg/http"
-	"github.com/nakamorg/calbridge/pkg/util"
+	"github.com/nakamorg/calbridge/pkg/oauth2"
 )
 
 type Client struct {
-	url string
-	c   *caldav.Client
+	url        string
+	endpoint   *url.URL
+	httpClient http.HTTPClient
+	c          *caldav.Client
+
+	mu sync.Mutex
+	// Calendars selected with SetCalendars
+	scan           []string
+	importCalendar string
+	// Resolved path of importCalendar
+	importPath string
+	// Email address of the owner of the calendars
+	address string
+}
+
+// Credentials of a CalDAV account
+type Credentials struct {
+	Username string
+	Password string
+	// Authentication scheme, see http.HTTPClientWithAuth. Negotiated with the server if empty.
+	Auth string
+	// Tokens authenticate with OAuth2 bearer tokens instead of Password when set
+	Tokens oauth2.TokenSource
 }
 
-func NewClient(username, password, url string) (*Client, error) {
-	c, err := caldav.NewClient(http.HTTPClientWithDigestAuth(nil, username, password), url)
+// httpClient returns the HTTP client authenticating with the credentials
+func (c Credentials) httpClient() (http.HTTPClient, error) {
+	if c.Tokens != nil {
+		return http.HTTPClientWithBearerAuth(nil, c.Tokens), nil
+	}
+	return http.HTTPClientWithAuth(nil, c.Auth, c.Username, c.Password)
+}
+
+// NewClient returns a client of the calendars at endpoint
+func NewClient(creds Credentials, endpoint string) (*Client, error) {
+	httpClient, err := creds.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	c, err := caldav.NewClient(httpClient, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(endpoint)
 	if err != nil {
 		return nil, err
 	}
 	return &Client{
-		url: url,
-		c:   c,
+		url:        endpoint,
+		endpoint:   u,
+		httpClient: httpClient,
+		c:          c,
 	}, nil
 }
 
-// GetCalendarObject returns the CalendarObjects from your calendar between the start and end time
+// GetCalendarObject returns the CalendarObjects from your calendars between the start and end time
 func (c *Client) GetCalendarObject(ctx context.Context, start, end time.Time) ([]caldav.CalendarObject, error) {
 	var calObjects []caldav.CalendarObject
 	caldavClient := c.c
 
-	calendars, err := caldavClient.FindCalendars(ctx, "")
+	calendars, err := c.scannedCalendars(ctx)
 	if err != nil {
 		return calObjects, err
 	}
@@ -48,10 +93,14 @@ func (c *Client) GetCalendarObject(ctx context.Context, start, end time.Time) ([
 				}},
 			},
 		}
-		return caldavClient.QueryCalendar(ctx, calendar.Path, &calendarQuery)
+		objects, err := caldavClient.QueryCalendar(ctx, calendar.Path, &calendarQuery)
+		if err != nil {
+			return nil, fmt.Errorf("failed querying calendar %s: %w", calendar.Path, err)
+		}
+		calObjects = append(calObjects, objects...)
 	}
 
-	return calObjects, fmt.Errorf("no calendars found")
+	return calObjects, nil
 }
 
 // GetEvents returns the CalendarObjects from your calendar between the start and end time
@@ -68,27 +117,110 @@ func (c *Client) GetEvents(ctx context.Context, start, end time.Time) ([]*ical.C
 	return events, nil
 }
 
-// PutEvent puts the Calendar event in your calendar. It removes the METHOD property from the event.
-// If the METHOD property value was CANCEL, it'll try to remove the event from the server.
-func (c *Client) PutEvent(ctx context.Context, cal *ical.Calendar) error {
-	caldavClient := c.c
+// errPreconditionFailed is returned when the calendar object was changed since it was read
+var errPreconditionFailed = errors.New("calendar object was changed concurrently")
 
-	uid, err := util.EventUid(cal)
+// putObject writes cal to path if the object there still has etag, or if there is no object
+// there when etag is empty
+func (c *Client) putObject(ctx context.Context, path string, cal *ical.Calendar, etag string) error {
+	if err := c.checkWeakETag(ctx, path, etag); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := ical.NewEncoder(&buf).Encode(cal); err != nil {
+		return err
+	}
+	u := c.endpoint.ResolveReference(&url.URL{Path: path})
+	req, err := nethttp.NewRequestWithContext(ctx, nethttp.MethodPut, u.String(), &buf)
 	if err != nil {
-		return fmt.Errorf("could not calculate path to save the event: %v", err)
+		return err
 	}
-	path := fmt.Sprintf("%s.%s", uid, ical.Extension)
-	if strings.HasPrefix(string(ical.EventCancelled), methodProp(cal)) {
-		caldavClient.RemoveAll(ctx, path) // ignore any errors here
-		return nil
+	req.Header.Set("Content-Type", ical.MIMEType)
+	setPrecondition(req, etag)
+	return c.doConditional(req, path)
+}
+
+// deleteObject removes the object at path if it still has etag
+func (c *Client) deleteObject(ctx context.Context, path, etag string) error {
+	if err := c.checkWeakETag(ctx, path, etag); err != nil {
+		return err
 	}
-	cal.Props.Del(ical.PropMethod)
-	if _, err := caldavClient.PutCalendarObject(ctx, path, cal); err != nil {
+	u := c.endpoint.ResolveReference(&url.URL{Path: path})
+	req, err := nethttp.NewRequestWithContext(ctx, nethttp.MethodDelete, u.String(), nil)
+	if err != nil {
 		return err
 	}
+	setPrecondition(req, etag)
+	return c.doConditional(req, path)
+}
+
+func (c *Client) doConditional(req *nethttp.Request, path string) error {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == nethttp.StatusPreconditionFailed:
+		return fmt.Errorf("%s on %s: %w", req.Method, path, errPreconditionFailed)
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("%s on %s failed: %s", req.Method, path, resp.Status)
+	}
 	return nil
 }
 
+// setPrecondition makes the request apply only to the object version with etag, or only if
+// there is no object when etag is empty. If-Match compares ETags strongly (RFC 9110) so a weak
+// etag never matches, it is checked by checkWeakETag instead.
+func setPrecondition(req *nethttp.Request, etag string) {
+	if etag == "" {
+		req.Header.Set("If-None-Match", "*")
+		return
+	}
+	if strings.HasPrefix(etag, "W/") {
+		return
+	}
+	if !strings.HasPrefix(etag, `"`) {
+		etag = `"` + etag + `"`
+	}
+	req.Header.Set("If-Match", etag)
+}
+
+// checkWeakETag fails with errPreconditionFailed if etag is weak and the object at path no longer
+// has it. The object is only read right before it is written, this narrows the window for a
+// concurrent change but does not close it like If-Match does for strong etags.
+func (c *Client) checkWeakETag(ctx context.Context, path, etag string) error {
+	if !strings.HasPrefix(etag, "W/") {
+		return nil
+	}
+	ms, err := c.propfind(ctx, path, "0", etagQuery)
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.code == nethttp.StatusNotFound {
+		return fmt.Errorf("%s is gone: %w", path, errPreconditionFailed)
+	}
+	if err != nil {
+		return err
+	}
+	for _, resp := range ms.Responses {
+		for _, ps := range resp.Propstats {
+			if isSuccess(ps.Status) && weakETag(unquoteETag(ps.Prop.ETag)) == weakETag(etag) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s has another etag: %w", path, errPreconditionFailed)
+}
+
+// weakETag returns the opaque tag of the etag, for weak comparison (RFC 9110 section 8.8.3.2)
+func weakETag(etag string) string {
+	return unquoteETag(strings.TrimPrefix(etag, "W/"))
+}
+
+// objectPath returns the path of the new calendar object with uid in the calendar at calendarPath
+func objectPath(calendarPath, uid string) string {
+	return fmt.Sprintf("%s/%s.%s", strings.TrimSuffix(calendarPath, "/"), uid, ical.Extension)
+}
+
 func methodProp(cal *ical.Calendar) string {
 	if cal == nil {
 		return ""
@@ -0,0 +1,151 @@
+package caldav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	nethttp "net/http"
+	"net/url"
+	"strings"
+
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/caldav"
+	"github.com/nakamorg/calbridge/pkg/http"
+)
+
+const wellKnownPath = "/.well-known/caldav"
+
+// NeedsDiscovery reports whether endpoint is only a domain or the base URL of a server, whose
+// calendars have to be discovered with Discover
+func NeedsDiscovery(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		// A bare domain, like example.com
+		return true
+	}
+	return u.Path == "" || u.Path == "/"
+}
+
+// Discover returns the URL of the calendar home set of the user on server, as per RFC 6764.
+// server is a domain, like example.com, or the base URL of the CalDAV server. The context path of
+// the server is looked up in the _caldavs._tcp (or _caldav._tcp for http URLs) SRV and TXT
+// records of the domain, falling back to /.well-known/caldav. The current-user-principal of the
+// user is then found under the context path and its calendar-home-set is returned.
+func Discover(ctx context.Context, creds Credentials, server string) (string, error) {
+	u, err := url.Parse(server)
+	if err != nil || u.Host == "" {
+		u = &url.URL{Scheme: "https", Host: strings.Trim(server, "/")}
+	}
+	httpClient, err := creds.httpClient()
+	if err != nil {
+		return "", err
+	}
+
+	var errs []error
+	for _, contextURL := range contextURLs(ctx, u) {
+		home, err := findCalendarHomeSet(ctx, httpClient, contextURL)
+		if err == nil {
+			return home, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", contextURL, err))
+	}
+	return "", fmt.Errorf("failed discovering the calendars on %s: %w", server, errors.Join(errs...))
+}
+
+// contextURLs returns the candidate context URLs of the CalDAV server at u, most specific first
+func contextURLs(ctx context.Context, u *url.URL) []string {
+	var urls []string
+	if srv, err := lookupSRV(ctx, u); err == nil {
+		urls = append(urls, srv)
+	}
+	wellKnown := url.URL{Scheme: u.Scheme, Host: u.Host, Path: wellKnownPath}
+	urls = append(urls, resolveRedirect(ctx, wellKnown.String()))
+	root := url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}
+	return append(urls, root.String())
+}
+
+// lookupSRV returns the context URL advertised in the SRV and TXT records of the domain of u
+func lookupSRV(ctx context.Context, u *url.URL) (string, error) {
+	service := "caldavs"
+	if u.Scheme == "http" {
+		service = "caldav"
+	}
+	var resolver net.Resolver
+	_, addrs, err := resolver.LookupSRV(ctx, service, "tcp", u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	// A target of "." means that the service is not available for the domain (RFC 2782)
+	if len(addrs) == 0 || addrs[0].Target == "." {
+		return "", fmt.Errorf("no %s service for %s", service, u.Hostname())
+	}
+	target := strings.TrimSuffix(addrs[0].Target, ".")
+
+	path := wellKnownPath
+	if txts, err := resolver.LookupTXT(ctx, "_"+service+"._tcp."+u.Hostname()); err == nil {
+		for _, txt := range txts {
+			if value, ok := strings.CutPrefix(txt, "path="); ok && value != "" {
+				path = value
+			}
+		}
+	}
+
+	srv := url.URL{Scheme: u.Scheme, Host: net.JoinHostPort(target, fmt.Sprint(addrs[0].Port)), Path: path}
+	if path == wellKnownPath {
+		return resolveRedirect(ctx, srv.String()), nil
+	}
+	return srv.String(), nil
+}
+
+// resolveRedirect returns the location the well-known URL redirects to, or the URL itself if
+// it is not redirected. Redirects are not left to the HTTP client as it would turn the
+// PROPFIND requests into GET ones.
+func resolveRedirect(ctx context.Context, wellKnown string) string {
+	client := &nethttp.Client{
+		CheckRedirect: func(*nethttp.Request, []*nethttp.Request) error {
+			return nethttp.ErrUseLastResponse
+		},
+	}
+	req, err := nethttp.NewRequestWithContext(ctx, nethttp.MethodGet, wellKnown, nil)
+	if err != nil {
+		return wellKnown
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return wellKnown
+	}
+	resp.Body.Close()
+	location, err := resp.Location()
+	if err != nil || resp.StatusCode/100 != 3 {
+		return wellKnown
+	}
+	return location.String()
+}
+
+// findCalendarHomeSet returns the URL of the calendar home set of the current user, starting
+// from the context URL of the server
+func findCalendarHomeSet(ctx context.Context, httpClient http.HTTPClient, contextURL string) (string, error) {
+	wc, err := webdav.NewClient(httpClient, contextURL)
+	if err != nil {
+		return "", err
+	}
+	principal, err := wc.FindCurrentUserPrincipal(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed finding the current user principal: %w", err)
+	}
+	c, err := caldav.NewClient(httpClient, contextURL)
+	if err != nil {
+		return "", err
+	}
+	home, err := c.FindCalendarHomeSet(ctx, principal)
+	if err != nil {
+		return "", fmt.Errorf("failed finding the calendar home set of %s: %w", principal, err)
+	}
+
+	base, err := url.Parse(contextURL)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(&url.URL{Path: home}).String(), nil
+}
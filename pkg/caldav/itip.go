@@ -0,0 +1,365 @@
+package caldav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/nakamorg/calbridge/pkg/util"
+)
+
+// iTIP methods as defined in RFC 5546 section 1.4
+const (
+	MethodPublish        = "PUBLISH"
+	MethodRequest        = "REQUEST"
+	MethodReply          = "REPLY"
+	MethodAdd            = "ADD"
+	MethodCancel         = "CANCEL"
+	MethodRefresh        = "REFRESH"
+	MethodCounter        = "COUNTER"
+	MethodDeclineCounter = "DECLINECOUNTER"
+)
+
+// maxPutAttempts is how many times a message is applied to an event which keeps changing
+const maxPutAttempts = 3
+
+var (
+	// ErrStale is returned when the scheduling message is older than the event in the calendar
+	ErrStale = errors.New("scheduling message is older than the calendar event")
+	// ErrUnknownEvent is returned when the scheduling message refers to an event which is not in the calendar
+	ErrUnknownEvent = errors.New("scheduling message refers to an unknown event")
+	// ErrNeedsOrganizer is returned for the scheduling messages which can not be applied to the
+	// calendar and need the organizer (or attendee, for DECLINECOUNTER) to act on them
+	ErrNeedsOrganizer = errors.New("scheduling message needs to be handled by the organizer")
+)
+
+// PutEvent applies the iTIP (RFC 5546) scheduling message in cal to the event of the same UID in
+// any of the searched calendars, or to the import calendar if the event is in none of them:
+//   - PUBLISH and REQUEST create or update the event. A message with only some instances of a
+//     recurring event updates those instances.
+//   - REPLY updates the participation status of the replying attendees in the organizer's copy.
+//   - ADD appends the instances to the existing recurring event.
+//   - CANCEL removes the event or, if the message has a RECURRENCE-ID, the cancelled instances.
+//   - COUNTER, REFRESH and DECLINECOUNTER are not applied, ErrNeedsOrganizer is returned.
+//
+// Messages older than the event in the calendar, as per their SEQUENCE and DTSTAMP, are rejected
+// with ErrStale. A missing METHOD is treated as PUBLISH. Updates of an existing event keep the
+// changes made to it locally, see keepLocalChanges. The event is written only if it was not
+// changed since it was read, the message is applied again otherwise.
+func (c *Client) PutEvent(ctx context.Context, cal *ical.Calendar) error {
+	uid, err := util.EventUid(cal)
+	if err != nil {
+		return fmt.Errorf("could not calculate path to save the event: %v", err)
+	}
+	method := strings.ToUpper(methodProp(cal))
+	if method == "" {
+		method = MethodPublish
+	}
+	switch method {
+	case MethodCounter, MethodRefresh, MethodDeclineCounter:
+		return fmt.Errorf("%w: %s for %s", ErrNeedsOrganizer, method, uid)
+	case MethodPublish, MethodRequest, MethodReply, MethodAdd, MethodCancel:
+	default:
+		return fmt.Errorf("unsupported scheduling method %q", method)
+	}
+
+	calendarPath, err := c.importCalendarPath(ctx)
+	if err != nil {
+		return fmt.Errorf("failed finding the import calendar: %v", err)
+	}
+	// The event might be changed by someone else between reading and writing it, in which case
+	// the message is applied again to the new version
+	for attempt := 1; ; attempt++ {
+		err := c.putEvent(ctx, calendarPath, uid, method, cal)
+		if !errors.Is(err, errPreconditionFailed) || attempt == maxPutAttempts {
+			return err
+		}
+	}
+}
+
+// putEvent applies the message in cal to the current version of the event with uid, wherever it is
+// among the searched calendars, like an event the user organizes in another calendar. New events
+// are added to the calendar at calendarPath.
+func (c *Client) putEvent(ctx context.Context, calendarPath, uid, method string, cal *ical.Calendar) error {
+	path := objectPath(calendarPath, uid)
+	var etag string
+	existing, err := c.FindEvent(ctx, uid)
+	if err != nil {
+		return fmt.Errorf("failed getting the calendar event: %v", err)
+	}
+	var stored *ical.Calendar
+	if existing != nil {
+		// FindEvent only returns the event of the exact same UID, the message must never be
+		// applied to, or delete, the event of another UID
+		path, etag = existing.Path, existing.ETag
+		stored = existing.Data
+		if err := checkStale(stored, cal, method); err != nil {
+			return fmt.Errorf("%s %s for %s: %w", method, sequenceInfo(cal), uid, err)
+		}
+	}
+
+	var updated *ical.Calendar
+	switch method {
+	case MethodPublish, MethodRequest:
+		if updated, err = cloneCalendar(cal); err != nil {
+			return err
+		}
+		if stored != nil {
+			c.keepLocalChanges(stored, updated)
+		}
+		updated = applyRequest(stored, updated)
+	case MethodReply:
+		if stored == nil {
+			return fmt.Errorf("%w: REPLY for %s", ErrUnknownEvent, uid)
+		}
+		if updated, err = applyReply(stored, cal); err != nil {
+			return err
+		}
+	case MethodAdd:
+		if stored == nil {
+			return fmt.Errorf("%w: ADD for %s, the organizer needs to send the whole event", ErrUnknownEvent, uid)
+		}
+		updated = applyAdd(stored, cal)
+	case MethodCancel:
+		if stored == nil {
+			return nil
+		}
+		if updated = applyCancel(stored, cal); updated == nil {
+			return c.deleteObject(ctx, path, etag)
+		}
+	}
+
+	return c.putObject(ctx, path, withoutMethod(updated), etag)
+}
+
+// applyRequest returns the calendar after applying the PUBLISH or REQUEST message to it. A
+// message with the master event replaces the stored calendar, otherwise the instances in the
+// message replace their stored counterparts.
+func applyRequest(stored, msg *ical.Calendar) *ical.Calendar {
+	if stored == nil {
+		return msg
+	}
+	for _, e := range msg.Events() {
+		if util.RecurrenceID(e.Component) == "" {
+			return msg
+		}
+	}
+	for _, e := range msg.Events() {
+		replaceInstance(stored, e.Component)
+	}
+	addMissingTimezones(stored, msg)
+	return stored
+}
+
+// applyReply updates the participation status of the replying attendees in the stored calendar
+func applyReply(stored, msg *ical.Calendar) (*ical.Calendar, error) {
+	updated := false
+	for _, reply := range msg.Events() {
+		// Replies for single instances of a recurring event which have no override are skipped,
+		// applying them to the master event would change the status for the whole series
+		event := findInstance(stored, util.RecurrenceID(reply.Component))
+		if event == nil {
+			continue
+		}
+		for _, replied := range reply.Props.Values(ical.PropAttendee) {
+			attendees := event.Props[ical.PropAttendee]
+			for i := range attendees {
+				if !sameAddress(attendees[i].Value, replied.Value) {
+					continue
+				}
+				for _, param := range []string{ical.ParamParticipationStatus, ical.ParamDelegatedTo, "SCHEDULE-STATUS"} {
+					if value := replied.Params.Get(param); value != "" {
+						attendees[i].Params.Set(param, value)
+					}
+				}
+				updated = true
+			}
+		}
+	}
+	if !updated {
+		return nil, fmt.Errorf("%w: REPLY does not match any attendee or instance of the calendar event", ErrUnknownEvent)
+	}
+	return stored, nil
+}
+
+// applyAdd appends the instances in the ADD message to the stored recurring event. The instances
+// are added as overrides of new RDATEs of the master event.
+func applyAdd(stored, msg *ical.Calendar) *ical.Calendar {
+	master := findInstance(stored, "")
+	for _, e := range msg.Events() {
+		start := e.Props.Get(ical.PropDateTimeStart)
+		if start == nil {
+			continue
+		}
+		instance := e.Component
+		if instance.Props.Get(ical.PropRecurrenceID) == nil {
+			recurrenceID := *start
+			recurrenceID.Name = ical.PropRecurrenceID
+			recurrenceID.Params = util.CloneParams(start.Params)
+			instance.Props.Set(&recurrenceID)
+		}
+		if master != nil {
+			rdate := *start
+			rdate.Name = ical.PropRecurrenceDates
+			rdate.Params = util.CloneParams(start.Params)
+			master.Props.Add(&rdate)
+		}
+		replaceInstance(stored, instance)
+	}
+	addMissingTimezones(stored, msg)
+	return stored
+}
+
+// applyCancel removes the cancelled instances from the stored calendar. It returns nil if the
+// whole event was cancelled.
+func applyCancel(stored, msg *ical.Calendar) *ical.Calendar {
+	master := findInstance(stored, "")
+	for _, e := range msg.Events() {
+		id := util.RecurrenceID(e.Component)
+		if id == "" {
+			return nil
+		}
+		removeInstance(stored, id)
+		if master != nil {
+			exdate := *e.Props.Get(ical.PropRecurrenceID)
+			exdate.Name = ical.PropExceptionDates
+			exdate.Params = util.CloneParams(exdate.Params)
+			exdate.Params.Del("RANGE")
+			master.Props.Add(&exdate)
+		}
+	}
+	if len(stored.Events()) == 0 {
+		return nil
+	}
+	return stored
+}
+
+// checkStale returns ErrStale if any of the events in msg is older than its stored counterpart
+func checkStale(stored, msg *ical.Calendar, method string) error {
+	for _, e := range msg.Events() {
+		current := findInstance(stored, util.RecurrenceID(e.Component))
+		if current == nil {
+			current = findInstance(stored, "")
+		}
+		if current == nil {
+			continue
+		}
+		seq, currentSeq := sequence(e.Component), sequence(current)
+		if seq < currentSeq {
+			return ErrStale
+		}
+		// Replies carry the sequence of the event they reply to, only the sequence matters for them
+		if method == MethodReply || seq > currentSeq {
+			continue
+		}
+		stamp, currentStamp := dtstamp(e.Component), dtstamp(current)
+		if !stamp.IsZero() && !currentStamp.IsZero() && stamp.Before(currentStamp) {
+			return ErrStale
+		}
+	}
+	return nil
+}
+
+// findInstance returns the event of cal with the RECURRENCE-ID, the master event if id is empty
+func findInstance(cal *ical.Calendar, id string) *ical.Component {
+	for _, e := range cal.Events() {
+		if util.RecurrenceID(e.Component) == id {
+			return e.Component
+		}
+	}
+	return nil
+}
+
+// replaceInstance replaces the event of cal having the same RECURRENCE-ID as event, or adds
+// event to cal if there is no such event
+func replaceInstance(cal *ical.Calendar, event *ical.Component) {
+	id := util.RecurrenceID(event)
+	for i, child := range cal.Children {
+		if child.Name == ical.CompEvent && util.RecurrenceID(child) == id {
+			cal.Children[i] = event
+			return
+		}
+	}
+	cal.Children = append(cal.Children, event)
+}
+
+func removeInstance(cal *ical.Calendar, id string) {
+	children := cal.Children[:0]
+	for _, child := range cal.Children {
+		if child.Name == ical.CompEvent && util.RecurrenceID(child) == id {
+			continue
+		}
+		children = append(children, child)
+	}
+	cal.Children = children
+}
+
+// addMissingTimezones copies the VTIMEZONEs of from which are not in to
+func addMissingTimezones(to, from *ical.Calendar) {
+	known := map[string]bool{}
+	for _, child := range to.Children {
+		if child.Name == ical.CompTimezone {
+			known[timezoneID(child)] = true
+		}
+	}
+	var timezones []*ical.Component
+	for _, child := range from.Children {
+		if child.Name == ical.CompTimezone && !known[timezoneID(child)] {
+			timezones = append(timezones, child)
+		}
+	}
+	to.Children = append(timezones, to.Children...)
+}
+
+func timezoneID(timezone *ical.Component) string {
+	id, _ := timezone.Props.Text(ical.PropTimezoneID)
+	return id
+}
+
+func sequence(event *ical.Component) int {
+	prop := event.Props.Get(ical.PropSequence)
+	if prop == nil {
+		return 0
+	}
+	seq, _ := prop.Int()
+	return seq
+}
+
+func dtstamp(event *ical.Component) time.Time {
+	t, _ := event.Props.DateTime(ical.PropDateTimeStamp, time.UTC)
+	return t
+}
+
+func sequenceInfo(cal *ical.Calendar) string {
+	events := cal.Events()
+	if len(events) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("(SEQUENCE %d)", sequence(events[0].Component))
+}
+
+// withoutMethod returns a shallow copy of cal without the METHOD property, as calendar objects
+// can not have one. cal is left untouched.
+func withoutMethod(cal *ical.Calendar) *ical.Calendar {
+	props := make(ical.Props, len(cal.Props))
+	for name, values := range cal.Props {
+		if name != ical.PropMethod {
+			props[name] = values
+		}
+	}
+	return &ical.Calendar{Component: &ical.Component{
+		Name:     cal.Name,
+		Props:    props,
+		Children: cal.Children,
+	}}
+}
+
+func sameAddress(a, b string) bool {
+	trim := func(s string) string {
+		return strings.TrimPrefix(strings.ToLower(s), "mailto:")
+	}
+	return trim(a) == trim(b)
+}
@@ -0,0 +1,118 @@
+package caldav
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/emersion/go-ical"
+	"github.com/nakamorg/calbridge/pkg/util"
+)
+
+// SetAddress sets the email address of the owner of the calendars. The participation status of
+// the owner in the imported events is kept when the organizer sends an update.
+func (c *Client) SetAddress(address string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.address = address
+}
+
+// keepLocalChanges copies to the events of the msg the changes made to their stored version
+// which the organizer does not know about: the participation status of the owner, unless the
+// event was rescheduled and the owner has to respond again, the alarms and the X- properties.
+// Events of msg which are not stored yet get the alarms of the stored master event.
+func (c *Client) keepLocalChanges(stored, msg *ical.Calendar) {
+	c.mu.Lock()
+	address := c.address
+	c.mu.Unlock()
+
+	keepXProps(stored.Component, msg.Component)
+	for _, e := range msg.Events() {
+		local := findInstance(stored, util.RecurrenceID(e.Component))
+		if local == nil {
+			if master := findInstance(stored, ""); master != nil {
+				keepAlarms(master, e.Component)
+			}
+			continue
+		}
+		keepAlarms(local, e.Component)
+		keepXProps(local, e.Component)
+		if address != "" && !rescheduled(local, e.Component) {
+			keepPartStat(local, e.Component, address)
+		}
+	}
+}
+
+// keepAlarms copies the alarms of local to event, unless the organizer set alarms on event
+func keepAlarms(local, event *ical.Component) {
+	for _, child := range event.Children {
+		if child.Name == ical.CompAlarm {
+			return
+		}
+	}
+	for _, child := range local.Children {
+		if child.Name == ical.CompAlarm {
+			event.Children = append(event.Children, child)
+		}
+	}
+}
+
+// keepXProps copies the X- properties of local which are missing from component
+func keepXProps(local, component *ical.Component) {
+	for name, props := range local.Props {
+		if strings.HasPrefix(name, "X-") && len(component.Props[name]) == 0 {
+			component.Props[name] = props
+		}
+	}
+}
+
+// keepPartStat copies the participation status of the attendee with address in local to event,
+// if the organizer does not know it yet
+func keepPartStat(local, event *ical.Component, address string) {
+	var localStatus string
+	for _, prop := range local.Props.Values(ical.PropAttendee) {
+		if sameAddress(prop.Value, address) {
+			localStatus = prop.Params.Get(ical.ParamParticipationStatus)
+		}
+	}
+	if localStatus == "" {
+		return
+	}
+	attendees := event.Props[ical.PropAttendee]
+	for i := range attendees {
+		if !sameAddress(attendees[i].Value, address) {
+			continue
+		}
+		status := attendees[i].Params.Get(ical.ParamParticipationStatus)
+		if status == "" || strings.EqualFold(status, "NEEDS-ACTION") {
+			attendees[i].Params.Set(ical.ParamParticipationStatus, localStatus)
+		}
+	}
+}
+
+// rescheduled reports whether the time or the recurrence of the event changed
+func rescheduled(local, event *ical.Component) bool {
+	for _, name := range []string{ical.PropDateTimeStart, ical.PropDateTimeEnd, ical.PropDuration,
+		ical.PropRecurrenceRule, ical.PropRecurrenceDates, ical.PropExceptionDates} {
+		if propValues(local, name) != propValues(event, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func propValues(component *ical.Component, name string) string {
+	var values []string
+	for _, prop := range component.Props.Values(name) {
+		values = append(values, prop.Value)
+	}
+	return strings.Join(values, ",")
+}
+
+// cloneCalendar returns a deep copy of cal
+func cloneCalendar(cal *ical.Calendar) (*ical.Calendar, error) {
+	var buf bytes.Buffer
+	if err := ical.NewEncoder(&buf).Encode(cal); err != nil {
+		return nil, err
+	}
+	return ical.NewDecoder(&buf).Decode()
+}
@@ -0,0 +1,183 @@
+package caldav
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"net/url"
+	"strings"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav/caldav"
+	"github.com/nakamorg/calbridge/pkg/util"
+)
+
+// The go-webdav client does not support property filters nor collection synchronization, so the
+// requests which need them are built here.
+
+type multistatus struct {
+	XMLName   xml.Name   `xml:"DAV: multistatus"`
+	Responses []response `xml:"DAV: response"`
+	SyncToken string     `xml:"DAV: sync-token"`
+}
+
+type response struct {
+	Href      string     `xml:"DAV: href"`
+	Status    string     `xml:"DAV: status"`
+	Propstats []propstat `xml:"DAV: propstat"`
+}
+
+type propstat struct {
+	Status string `xml:"DAV: status"`
+	Prop   struct {
+		ETag         string `xml:"DAV: getetag"`
+		CTag         string `xml:"http://calendarserver.org/ns/ getctag"`
+		CalendarData string `xml:"urn:ietf:params:xml:ns:caldav calendar-data"`
+	} `xml:"DAV: prop"`
+}
+
+const uidQuery = `<?xml version="1.0" encoding="utf-8"?>
+<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop>
+    <D:getetag/>
+    <C:calendar-data/>
+  </D:prop>
+  <C:filter>
+    <C:comp-filter name="VCALENDAR">
+      <C:comp-filter name="VEVENT">
+        <C:prop-filter name="UID">
+          <C:text-match collation="i;octet">%s</C:text-match>
+        </C:prop-filter>
+      </C:comp-filter>
+    </C:comp-filter>
+  </C:filter>
+</C:calendar-query>`
+
+// FindEvent returns the calendar object of the event with uid, regardless of when the event
+// happens, or nil if there is no such event in any of the scanned calendars or the import calendar
+func (c *Client) FindEvent(ctx context.Context, uid string) (*caldav.CalendarObject, error) {
+	paths, err := c.searchedCalendars(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		obj, err := c.findObject(ctx, path, uid)
+		if err != nil || obj != nil {
+			return obj, err
+		}
+	}
+	return nil, nil
+}
+
+// findObject returns the calendar object of the event with uid in the calendar at path, or nil if
+// the calendar has no such event. The text-match of the query is a substring match, the objects it
+// returns are filtered on their exact UID.
+func (c *Client) findObject(ctx context.Context, path, uid string) (*caldav.CalendarObject, error) {
+	var escaped strings.Builder
+	if err := xml.EscapeText(&escaped, []byte(uid)); err != nil {
+		return nil, err
+	}
+	ms, err := c.report(ctx, path, "1", fmt.Sprintf(uidQuery, escaped.String()))
+	if err != nil {
+		return nil, err
+	}
+	objects, err := ms.calendarObjects()
+	if err != nil {
+		return nil, err
+	}
+	for i := range objects {
+		if objUID, err := util.EventUid(objects[i].Data); err == nil && objUID == uid {
+			return &objects[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// report sends the REPORT request with body to path and returns the multistatus response
+func (c *Client) report(ctx context.Context, path, depth, body string) (*multistatus, error) {
+	return c.multistatus(ctx, "REPORT", path, depth, body)
+}
+
+// propfind sends the PROPFIND request with body to path and returns the multistatus response
+func (c *Client) propfind(ctx context.Context, path, depth, body string) (*multistatus, error) {
+	return c.multistatus(ctx, "PROPFIND", path, depth, body)
+}
+
+// statusError is returned when the server does not answer a request with a multistatus
+type statusError struct {
+	method, path string
+	code         int
+	status       string
+	// Start of the response body, which might hold the precondition that failed
+	body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s on %s failed: %s", e.method, e.path, e.status)
+}
+
+// multistatus sends the request with method and body to path and returns the multistatus response
+func (c *Client) multistatus(ctx context.Context, method, path, depth, body string) (*multistatus, error) {
+	u := c.endpoint.ResolveReference(&url.URL{Path: path})
+	req, err := nethttp.NewRequestWithContext(ctx, method, u.String(), strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Depth", depth)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusMultiStatus {
+		content, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &statusError{method: method, path: path, code: resp.StatusCode, status: resp.Status, body: string(content)}
+	}
+
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("failed decoding %s response: %v", method, err)
+	}
+	return &ms, nil
+}
+
+// calendarObjects decodes the calendar objects of the successful responses
+func (ms *multistatus) calendarObjects() ([]caldav.CalendarObject, error) {
+	var objects []caldav.CalendarObject
+	for _, resp := range ms.Responses {
+		for _, ps := range resp.Propstats {
+			if !isSuccess(ps.Status) || ps.Prop.CalendarData == "" {
+				continue
+			}
+			cal, err := ical.NewDecoder(strings.NewReader(ps.Prop.CalendarData)).Decode()
+			if err != nil {
+				return nil, fmt.Errorf("failed decoding %s: %v", resp.Href, err)
+			}
+			objects = append(objects, caldav.CalendarObject{
+				Path: resp.path(),
+				ETag: unquoteETag(ps.Prop.ETag),
+				Data: cal,
+			})
+		}
+	}
+	return objects, nil
+}
+
+// isSuccess reports whether the status line, ex: "HTTP/1.1 200 OK", has a 2xx code
+func isSuccess(status string) bool {
+	fields := strings.Fields(status)
+	return len(fields) >= 2 && strings.HasPrefix(fields[1], "2")
+}
+
+// unquoteETag returns the value of a strong ETag, weak ETags are returned as is as they can not
+// be compared without the W/ prefix
+func unquoteETag(etag string) string {
+	if len(etag) >= 2 && strings.HasPrefix(etag, `"`) && strings.HasSuffix(etag, `"`) {
+		return etag[1 : len(etag)-1]
+	}
+	return etag
+}
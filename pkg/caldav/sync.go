@@ -0,0 +1,252 @@
+package caldav
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	nethttp "net/http"
+	"net/url"
+	"strings"
+
+	"github.com/emersion/go-webdav/caldav"
+	"github.com/nakamorg/calbridge/pkg/util"
+)
+
+const syncCollectionQuery = `<?xml version="1.0" encoding="utf-8"?>
+<D:sync-collection xmlns:D="DAV:">
+  <D:sync-token>%s</D:sync-token>
+  <D:sync-level>1</D:sync-level>
+  <D:prop>
+    <D:getetag/>
+  </D:prop>
+</D:sync-collection>`
+
+const ctagQuery = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:" xmlns:CS="http://calendarserver.org/ns/">
+  <D:prop>
+    <CS:getctag/>
+  </D:prop>
+</D:propfind>`
+
+const etagQuery = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:">
+  <D:prop>
+    <D:getetag/>
+  </D:prop>
+</D:propfind>`
+
+// SyncState is how far the changes of a calendar were read. Its zero value reads all the
+// objects of the calendar as created.
+type SyncState struct {
+	// Sync token of the calendar (RFC 6578), empty if the server does not support sync-collection
+	SyncToken string `json:"syncToken,omitempty"`
+	// CTag of the calendar, used instead of the sync token to tell whether the calendar changed
+	CTag string `json:"ctag,omitempty"`
+	// Objects of the calendar by their path, used to find the changed and deleted objects when
+	// the server does not support sync-collection and to tell the UID of the deleted objects
+	Objects map[string]ObjectState `json:"objects,omitempty"`
+}
+
+// ObjectState is the known version of a calendar object
+type ObjectState struct {
+	ETag string `json:"etag"`
+	UID  string `json:"uid"`
+}
+
+// Changes are the calendar objects created, modified and deleted since the last sync of a calendar
+type Changes struct {
+	Updated []caldav.CalendarObject
+	// UIDs of the deleted events
+	Deleted []string
+}
+
+// SyncCalendars returns the changes of the scanned calendars and the import calendar since their
+// sync states, given by calendar path, and the new sync states to pass on the next call. Servers
+// supporting sync-collection (RFC 6578) only report the changed objects, otherwise the CTag and
+// the ETags of the objects tell what changed.
+func (c *Client) SyncCalendars(ctx context.Context, states map[string]SyncState) (Changes, map[string]SyncState, error) {
+	var changes Changes
+	paths, err := c.searchedCalendars(ctx)
+	if err != nil {
+		return changes, nil, err
+	}
+	newStates := map[string]SyncState{}
+	for _, path := range paths {
+		calendarChanges, state, err := c.syncCalendar(ctx, path, states[path])
+		if err != nil {
+			return changes, nil, fmt.Errorf("failed syncing calendar %s: %w", path, err)
+		}
+		changes.Updated = append(changes.Updated, calendarChanges.Updated...)
+		changes.Deleted = append(changes.Deleted, calendarChanges.Deleted...)
+		newStates[path] = state
+	}
+	return changes, newStates, nil
+}
+
+// syncCalendar returns the changes of the calendar at path since state
+func (c *Client) syncCalendar(ctx context.Context, path string, state SyncState) (Changes, SyncState, error) {
+	if state.Objects == nil {
+		state.Objects = map[string]ObjectState{}
+	}
+	changed, deleted, token, err := c.syncCollection(ctx, path, state.SyncToken)
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && state.SyncToken != "" && strings.Contains(statusErr.body, "valid-sync-token") {
+		// The token expired, start over with a full sync. Objects deleted in the meantime are
+		// found by comparing with the known objects.
+		changed, deleted, token, err = c.syncCollection(ctx, path, "")
+		if err == nil {
+			deleted = missingObjects(state.Objects, changed)
+		}
+	}
+	if errors.As(err, &statusErr) && isUnsupported(statusErr.code) {
+		state.SyncToken = ""
+		changed, deleted, err = c.compareETags(ctx, path, &state)
+	}
+	if err != nil {
+		return Changes{}, state, err
+	}
+	state.SyncToken = token
+
+	var changes Changes
+	for _, objPath := range deleted {
+		if obj, ok := state.Objects[objPath]; ok {
+			changes.Deleted = append(changes.Deleted, obj.UID)
+			delete(state.Objects, objPath)
+		}
+	}
+	if len(changed) == 0 {
+		return changes, state, nil
+	}
+
+	var paths []string
+	for objPath := range changed {
+		paths = append(paths, objPath)
+	}
+	objects, err := c.c.MultiGetCalendar(ctx, path, &caldav.CalendarMultiGet{Paths: paths})
+	if err != nil {
+		return Changes{}, state, fmt.Errorf("failed getting the changed objects: %w", err)
+	}
+	for _, obj := range objects {
+		uid, err := util.EventUid(obj.Data)
+		if err != nil {
+			// Calendars might have other components, like tasks
+			continue
+		}
+		state.Objects[obj.Path] = ObjectState{ETag: unquoteETag(obj.ETag), UID: uid}
+		changes.Updated = append(changes.Updated, obj)
+	}
+	return changes, state, nil
+}
+
+// syncCollection returns the etags of the objects of the calendar at path changed since token,
+// the paths of the deleted ones and the new sync token
+func (c *Client) syncCollection(ctx context.Context, path, token string) (changed map[string]string, deleted []string, newToken string, err error) {
+	var escaped strings.Builder
+	if err := xml.EscapeText(&escaped, []byte(token)); err != nil {
+		return nil, nil, "", err
+	}
+	ms, err := c.report(ctx, path, "0", fmt.Sprintf(syncCollectionQuery, escaped.String()))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	changed = map[string]string{}
+	for _, resp := range ms.Responses {
+		objPath := resp.path()
+		if isCollection(path, objPath) {
+			continue
+		}
+		if resp.Status != "" && !isSuccess(resp.Status) {
+			deleted = append(deleted, objPath)
+			continue
+		}
+		for _, ps := range resp.Propstats {
+			if isSuccess(ps.Status) {
+				changed[objPath] = unquoteETag(ps.Prop.ETag)
+			}
+		}
+	}
+	return changed, deleted, ms.SyncToken, nil
+}
+
+// compareETags returns the objects of the calendar at path whose ETag differs from state and the
+// paths of the objects which are gone. Nothing is listed if the CTag of the calendar did not change.
+func (c *Client) compareETags(ctx context.Context, path string, state *SyncState) (changed map[string]string, deleted []string, err error) {
+	ms, err := c.propfind(ctx, path, "0", ctagQuery)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ctag string
+	for _, resp := range ms.Responses {
+		for _, ps := range resp.Propstats {
+			if isSuccess(ps.Status) && ps.Prop.CTag != "" {
+				ctag = ps.Prop.CTag
+			}
+		}
+	}
+	if ctag != "" && ctag == state.CTag {
+		return nil, nil, nil
+	}
+
+	if ms, err = c.propfind(ctx, path, "1", etagQuery); err != nil {
+		return nil, nil, err
+	}
+	changed = map[string]string{}
+	current := map[string]string{}
+	for _, resp := range ms.Responses {
+		objPath := resp.path()
+		if isCollection(path, objPath) {
+			continue
+		}
+		for _, ps := range resp.Propstats {
+			if !isSuccess(ps.Status) {
+				continue
+			}
+			etag := unquoteETag(ps.Prop.ETag)
+			current[objPath] = etag
+			if known, ok := state.Objects[objPath]; !ok || known.ETag != etag {
+				changed[objPath] = etag
+			}
+		}
+	}
+	for objPath := range state.Objects {
+		if _, ok := current[objPath]; !ok {
+			deleted = append(deleted, objPath)
+		}
+	}
+	state.CTag = ctag
+	return changed, deleted, nil
+}
+
+// missingObjects returns the paths of the known objects which are not in current
+func missingObjects(known map[string]ObjectState, current map[string]string) []string {
+	var missing []string
+	for objPath := range known {
+		if _, ok := current[objPath]; !ok {
+			missing = append(missing, objPath)
+		}
+	}
+	return missing
+}
+
+// isUnsupported reports whether the status code means that the server does not support the request
+func isUnsupported(code int) bool {
+	switch code {
+	case nethttp.StatusBadRequest, nethttp.StatusForbidden, nethttp.StatusMethodNotAllowed, nethttp.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// isCollection reports whether objPath is the calendar at path itself or a sub collection of it
+func isCollection(path, objPath string) bool {
+	return strings.HasSuffix(objPath, "/") || strings.TrimSuffix(objPath, "/") == strings.TrimSuffix(path, "/")
+}
+
+// path returns the path of the href of the response
+func (r response) path() string {
+	if u, err := url.Parse(r.Href); err == nil {
+		return u.Path
+	}
+	return r.Href
+}
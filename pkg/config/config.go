@@ -1,59 +1,138 @@
 package config
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 )
 
-type config struct {
+const (
+	// DefaultConcurrency is the number of users synced at the same time when the config does not set it
+	DefaultConcurrency = 4
+)
+
+type Config struct {
 	Users []User `json:"users"`
+	// Maximum number of users to sync at the same time. Defaults to DefaultConcurrency.
+	Concurrency int `json:"concurrency,omitempty"`
+	// Where the sync state, the users and the secrets are stored. Defaults to a bolt database in
+	// the data directory.
+	Storage *Storage `json:"storage,omitempty"`
+}
+
+type Storage struct {
+	// Type of the storage: bolt, file, sqlite or memory. Defaults to bolt.
+	Type string `json:"type,omitempty"`
+	// Path of the storage file, relative to the data directory. Defaults to a file named after the type.
+	Path string `json:"path,omitempty"`
+}
+
+// LoadStorage reads the storage settings of the config file at path, nil if there is no config
+// file or it does not set them. The rest of the config is only checked by LoadConfig.
+func LoadStorage(path string) (*Storage, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	root, err := parseConfigFile(path, data)
+	if err != nil {
+		return nil, parseError(path, err)
+	}
+	var settings struct {
+		Storage *Storage `json:"storage"`
+	}
+	if err = root.decode(&settings); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	lines := map[string]int{}
+	root.lines("", lines)
+	if problems := settings.Storage.validate(lines); len(problems) > 0 {
+		return nil, &Error{File: path, Problems: problems}
+	}
+	return settings.Storage, nil
+}
+
+// LoadConfig reads the json config file at path and fills in the defaults
+func LoadConfig(path string) (Config, error) {
+	conf, err := loadConfig(path)
+	if err != nil {
+		return conf, err
+	}
+	if conf.Concurrency <= 0 {
+		conf.Concurrency = DefaultConcurrency
+	}
+	return conf, nil
 }
 
-// loadConfig reads and returns the json config
-func loadConfig(path string) (config, error) {
-	var conf config
+// loadConfig reads and returns the config, in json, yaml or toml depending on the extension of
+// path, with the secret references resolved. Unknown fields are rejected and the config is
+// validated, all the problems being reported along with their line.
+func loadConfig(path string) (Config, error) {
+	var conf Config
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return conf, err
 	}
-	err = json.Unmarshal(data, &conf)
+	root, err := parseConfigFile(path, data)
+	if err != nil {
+		return conf, parseError(path, err)
+	}
+	if problems := checkFields(root, reflect.TypeOf(conf), ""); len(problems) > 0 {
+		sortProblems(problems)
+		return conf, &Error{File: path, Problems: problems}
+	}
+	if err = root.decode(&conf); err != nil {
+		return conf, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	lines := map[string]int{}
+	root.lines("", lines)
+	if problems := conf.validate(lines); len(problems) > 0 {
+		sortProblems(problems)
+		return conf, &Error{File: path, Problems: problems}
+	}
+
+	if err = conf.checkPermissions(path); err != nil {
+		return conf, err
+	}
+	err = conf.resolveSecrets()
 	return conf, err
 }
 
-// CreateSampleConfig creates a sample config file at path
+// parseError returns the error of parsing the config file at path, located by its line if known
+func parseError(path string, err error) error {
+	var lineErr lineError
+	if errors.As(err, &lineErr) {
+		return &Error{File: path, Problems: []Problem{{Line: lineErr.line, Message: lineErr.err.Error()}}}
+	}
+	return fmt.Errorf("invalid config %s: %w", path, err)
+}
+
+// CreateSampleConfig creates a sample config file at path, in json, yaml or toml depending on its
+// extension
 func CreateSampleConfig(path string) error {
-	config := config{
+	config := Config{
+		Concurrency: DefaultConcurrency,
 		Users: []User{
 			{
 				Name:      "user1",
 				Frequency: "1h",
-				CalDAV: struct {
-					URL       string `json:"url"`
-					Username  string `json:"username"`
-					Password  string `json:"password"`
-					EventDays int    `json:"eventDays"`
-				}{
+				CalDAV: CalDAV{
 					URL:       "https://caldav.example.com/calendars/user1/xyz/",
 					Username:  "user1",
 					Password:  "password1",
 					EventDays: 5,
 				},
-				SMTP: struct {
-					Host     string `json:"host"`
-					Username string `json:"username"`
-					Password string `json:"password"`
-				}{
+				SMTP: SMTP{
 					Host:     "mail.example.org",
 					Username: "user1@example.org",
 					Password: "password1",
 				},
-				IMAP: struct {
-					Host       string `json:"host"`
-					Username   string `json:"username"`
-					Password   string `json:"password"`
-					EmailHours int    `json:"emailHours"`
-				}{
+				IMAP: IMAP{
 					Host:       "mail.example.org",
 					Username:   "user1@example.org",
 					Password:   "password1",
@@ -62,19 +141,21 @@ func CreateSampleConfig(path string) error {
 			},
 		},
 	}
-	err := os.MkdirAll(filepath.Dir(path), 0744)
+	data, err := encodeConfig(path, config)
 	if err != nil {
 		return err
 	}
-	file, err := os.Create(path)
+	// The config holds passwords, only the owner may read it
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(config); err != nil {
+	if _, err := file.Write(data); err != nil {
 		return err
 	}
 	return file.Sync()
@@ -0,0 +1,522 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// node is a value of the config file along with the line it is defined at. value is one of
+// map[string]*node, []*node or a scalar: string, bool, nil or a number.
+type node struct {
+	line  int
+	value any
+}
+
+// parseConfigFile parses the config file, in json, yaml or toml depending on its extension
+func parseConfigFile(path string, data []byte) (*node, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return parseYAML(data)
+	case ".toml":
+		return parseTOML(data)
+	case ".json", "":
+		return parseJSON(data)
+	}
+	return nil, fmt.Errorf("unsupported config file format %s, use .json, .yaml, .yml or .toml", filepath.Ext(path))
+}
+
+// configFileNames are the names of the config file looked for in the config folder, by preference
+var configFileNames = []string{"config.json", "config.yaml", "config.yml", "config.toml"}
+
+// FindConfigFile returns the path of the config file in dir, config.json, config.yaml,
+// config.yml or config.toml, defaulting to config.json if there is none
+func FindConfigFile(dir string) string {
+	for _, name := range configFileNames {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(dir, configFileNames[0])
+}
+
+// encodeConfig encodes the config in json, yaml or toml depending on the extension of path
+func encodeConfig(path string, conf Config) ([]byte, error) {
+	data, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".yaml" && ext != ".yml" && ext != ".toml" {
+		return append(data, '\n'), nil
+	}
+
+	root, err := parseJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	value := root.plain()
+	if ext == ".toml" {
+		var b bytes.Buffer
+		err := toml.NewEncoder(&b).Encode(value)
+		return b.Bytes(), err
+	}
+	return yaml.Marshal(value)
+}
+
+// decode decodes the parsed config file into v, matching the keys with the json names of the fields
+func (n *node) decode(v any) error {
+	data, err := json.Marshal(n.plain())
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// plain returns the value of the node with the nodes of its children unwrapped
+func (n *node) plain() any {
+	switch value := n.value.(type) {
+	case map[string]*node:
+		m := map[string]any{}
+		for key, child := range value {
+			m[key] = child.plain()
+		}
+		return m
+	case []*node:
+		s := make([]any, len(value))
+		for i, child := range value {
+			s[i] = child.plain()
+		}
+		return s
+	case json.Number:
+		// Numbers are integers in the config
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+	}
+	return n.value
+}
+
+// lines returns the line of each value of the tree by its path, ex: users[0].caldav.url
+func (n *node) lines(path string, lines map[string]int) {
+	lines[path] = n.line
+	switch value := n.value.(type) {
+	case map[string]*node:
+		for key, child := range value {
+			child.lines(joinPath(path, key), lines)
+		}
+	case []*node:
+		for i, child := range value {
+			child.lines(fmt.Sprintf("%s[%d]", path, i), lines)
+		}
+	}
+}
+
+// joinPath returns the path of the key under path
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// parseJSON parses the json config, recording the line of every key and array item
+func parseJSON(data []byte) (*node, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	lineAt := func() int {
+		return 1 + bytes.Count(data[:decoder.InputOffset()], []byte("\n"))
+	}
+
+	var parseValue func(line int) (*node, error)
+	parseValue = func(line int) (*node, error) {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch token {
+		case json.Delim('{'):
+			m := map[string]*node{}
+			for decoder.More() {
+				key, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				keyLine := lineAt()
+				child, err := parseValue(keyLine)
+				if err != nil {
+					return nil, err
+				}
+				m[key.(string)] = child
+			}
+			if _, err := decoder.Token(); err != nil {
+				return nil, err
+			}
+			return &node{line: line, value: m}, nil
+		case json.Delim('['):
+			var s []*node
+			for decoder.More() {
+				child, err := parseValue(lineAt() + leadingNewlines(data[decoder.InputOffset():]))
+				if err != nil {
+					return nil, err
+				}
+				s = append(s, child)
+			}
+			if _, err := decoder.Token(); err != nil {
+				return nil, err
+			}
+			return &node{line: line, value: s}, nil
+		}
+		return &node{line: line, value: token}, nil
+	}
+
+	root, err := parseValue(1)
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return nil, lineError{line: 1 + bytes.Count(data[:syntaxErr.Offset], []byte("\n")), err: err}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("unexpected end of the json config")
+		}
+		return nil, err
+	}
+	return root, nil
+}
+
+// leadingNewlines returns the number of lines data starts with, before the next array item
+func leadingNewlines(data []byte) int {
+	trimmed := bytes.TrimLeft(data, " \t\r\n,")
+	return bytes.Count(data[:len(data)-len(trimmed)], []byte("\n"))
+}
+
+// parseYAML parses the yaml config, recording the line of every key and sequence item
+func parseYAML(data []byte) (*node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return &node{line: 1, value: map[string]*node{}}, nil
+	}
+	return yamlNode(doc.Content[0], doc.Content[0].Line)
+}
+
+func yamlNode(y *yaml.Node, line int) (*node, error) {
+	switch y.Kind {
+	case yaml.AliasNode:
+		return yamlNode(y.Alias, line)
+	case yaml.MappingNode:
+		m := map[string]*node{}
+		for i := 0; i+1 < len(y.Content); i += 2 {
+			key, value := y.Content[i], y.Content[i+1]
+			child, err := yamlNode(value, key.Line)
+			if err != nil {
+				return nil, err
+			}
+			m[key.Value] = child
+		}
+		return &node{line: line, value: m}, nil
+	case yaml.SequenceNode:
+		var s []*node
+		for _, item := range y.Content {
+			child, err := yamlNode(item, item.Line)
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, child)
+		}
+		return &node{line: line, value: s}, nil
+	}
+	var value any
+	if err := y.Decode(&value); err != nil {
+		return nil, lineError{line: y.Line, err: err}
+	}
+	return &node{line: line, value: value}, nil
+}
+
+// parseTOML parses the toml config. The lines of the keys are found by scanning the config as
+// the toml decoder does not tell them.
+func parseTOML(data []byte) (*node, error) {
+	var value map[string]any
+	if _, err := toml.Decode(string(data), &value); err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, lineError{line: parseErr.Position.Line, err: errors.New(parseErr.Message)}
+		}
+		return nil, err
+	}
+	return tomlNode(value, "", tomlLines(data)), nil
+}
+
+func tomlNode(value any, path string, lines map[string]int) *node {
+	n := &node{line: lines[path], value: value}
+	switch value := value.(type) {
+	case map[string]any:
+		m := map[string]*node{}
+		for key, child := range value {
+			m[key] = tomlNode(child, joinPath(path, key), lines)
+		}
+		n.value = m
+	case []map[string]any:
+		s := make([]*node, len(value))
+		for i, child := range value {
+			s[i] = tomlNode(child, fmt.Sprintf("%s[%d]", path, i), lines)
+		}
+		n.value = s
+	case []any:
+		s := make([]*node, len(value))
+		for i, child := range value {
+			s[i] = tomlNode(child, fmt.Sprintf("%s[%d]", path, i), lines)
+		}
+		n.value = s
+	case time.Time:
+		n.value = value.Format(time.RFC3339)
+	}
+	if n.line == 0 {
+		// Values of inline tables and arrays are at the line of their key
+		if i := strings.LastIndexAny(path, ".["); i != -1 {
+			n.line = lines[path[:i]]
+		}
+	}
+	return n
+}
+
+// tomlLines returns the line of each key and table of the toml config by path, ex: users[0].caldav.url
+func tomlLines(data []byte) map[string]int {
+	lines := map[string]int{}
+	// Number of tables of each array of tables, by path
+	arrays := map[string]int{}
+	// resolve returns the path of the dotted key, pointing to the last table of the arrays of tables
+	resolve := func(base string, key string) string {
+		path := base
+		for _, part := range splitTOMLKey(key) {
+			path = joinPath(path, part)
+			if n := arrays[path]; n > 0 {
+				path = fmt.Sprintf("%s[%d]", path, n-1)
+			}
+		}
+		return path
+	}
+
+	table := ""
+	multiline := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if multiline != "" {
+			// Skip the content of multi-line strings
+			if strings.Count(line, multiline)%2 == 1 {
+				multiline = ""
+			}
+			continue
+		}
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "[["):
+			header := strings.TrimSpace(strings.TrimSuffix(strings.SplitN(line[2:], "]]", 2)[0], "]]"))
+			parts := splitTOMLKey(header)
+			parent := resolve("", strings.Join(parts[:len(parts)-1], "."))
+			path := joinPath(parent, parts[len(parts)-1])
+			arrays[path]++
+			table = fmt.Sprintf("%s[%d]", path, arrays[path]-1)
+			if _, ok := lines[path]; !ok {
+				lines[path] = lineNum
+			}
+			lines[table] = lineNum
+		case strings.HasPrefix(line, "["):
+			table = resolve("", strings.SplitN(line[1:], "]", 2)[0])
+			lines[table] = lineNum
+		default:
+			key, rest, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+			lines[resolve(table, strings.TrimSpace(key))] = lineNum
+			for _, quote := range []string{`"""`, `'''`} {
+				if strings.Count(rest, quote)%2 == 1 {
+					multiline = quote
+				}
+			}
+		}
+	}
+	return lines
+}
+
+// splitTOMLKey splits the dotted toml key, ex: caldav."oauth2".token, into its unquoted parts
+func splitTOMLKey(key string) []string {
+	var parts []string
+	var part strings.Builder
+	quote := byte(0)
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			part.WriteByte(c)
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '.':
+			parts = append(parts, strings.TrimSpace(part.String()))
+			part.Reset()
+		case c != ' ' && c != '\t':
+			part.WriteByte(c)
+		}
+	}
+	return append(parts, strings.TrimSpace(part.String()))
+}
+
+// lineError is an error at a line of the config file
+type lineError struct {
+	line int
+	err  error
+}
+
+func (e lineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.line, e.err)
+}
+
+func (e lineError) Unwrap() error {
+	return e.err
+}
+
+// checkFields reports the keys of the tree which are not json names of the fields of t, as well
+// as the values whose type does not match the type of their field
+func checkFields(n *node, t reflect.Type, path string) []Problem {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if n.value == nil {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := n.value.(map[string]*node)
+		if !ok {
+			return []Problem{{Line: n.line, Field: path, Message: "expected an object"}}
+		}
+		fields := jsonFields(t)
+		var problems []Problem
+		for key, child := range m {
+			field, ok := fields[key]
+			if !ok {
+				problems = append(problems, Problem{Line: child.line, Field: joinPath(path, key), Message: unknownFieldMessage(key, fields)})
+				continue
+			}
+			problems = append(problems, checkFields(child, field, joinPath(path, key))...)
+		}
+		return problems
+	case reflect.Slice:
+		s, ok := n.value.([]*node)
+		if !ok {
+			return []Problem{{Line: n.line, Field: path, Message: "expected a list"}}
+		}
+		var problems []Problem
+		for i, child := range s {
+			problems = append(problems, checkFields(child, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return problems
+	case reflect.String:
+		if _, ok := n.value.(string); !ok {
+			return []Problem{{Line: n.line, Field: path, Message: fmt.Sprintf("expected a string, got %v", n.plain())}}
+		}
+	case reflect.Bool:
+		if _, ok := n.value.(bool); !ok {
+			return []Problem{{Line: n.line, Field: path, Message: fmt.Sprintf("expected true or false, got %v", n.plain())}}
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !isInteger(n.value) {
+			return []Problem{{Line: n.line, Field: path, Message: fmt.Sprintf("expected an integer, got %v", n.plain())}}
+		}
+	}
+	return nil
+}
+
+// isInteger reports whether the scalar is an integer
+func isInteger(value any) bool {
+	switch value := value.(type) {
+	case int, int64, uint64:
+		return true
+	case json.Number:
+		_, err := strconv.ParseInt(string(value), 10, 64)
+		return err == nil
+	case float64:
+		return value == float64(int64(value))
+	}
+	return false
+}
+
+// jsonFields returns the types of the fields of the struct by their json name, with the fields of
+// the embedded structs
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			for embedded, typ := range jsonFields(field.Type) {
+				fields[embedded] = typ
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// unknownFieldMessage describes the unknown key, suggesting the field it is likely a typo of
+func unknownFieldMessage(key string, fields map[string]reflect.Type) string {
+	normalized := strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(key))
+	best, bestDistance := "", 3
+	for name := range fields {
+		if d := editDistance(normalized, strings.ToLower(name)); d < bestDistance || (d == bestDistance && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+	if best == "" || bestDistance > 2 {
+		return "unknown field"
+	}
+	return fmt.Sprintf("unknown field, did you mean %s?", best)
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
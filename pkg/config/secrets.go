@@ -0,0 +1,176 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Prefixes of the secret references, which are resolved when the config is loaded
+const (
+	// env:VAR reads the environment variable VAR
+	secretEnvPrefix = "env:"
+	// file:/run/secrets/x reads the file
+	secretFilePrefix = "file:"
+	// cmd:pass show mail/work runs the command with the shell and reads its standard output
+	secretCmdPrefix = "cmd:"
+	// secret:NAME is the secret of the user named NAME in the encrypted secret store. It is
+	// resolved with ResolveStoredSecrets, once the store is open.
+	secretStorePrefix = "secret:"
+)
+
+// isSecretReference reports whether the secret is a reference rather than the secret itself
+func isSecretReference(secret string) bool {
+	for _, prefix := range []string{secretEnvPrefix, secretFilePrefix, secretCmdPrefix, secretStorePrefix} {
+		if strings.HasPrefix(secret, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveSecret returns the secret a reference like env:VAR, file:/run/secrets/x or
+// cmd:pass show mail/work points to. Other values are returned as is: they are the secret itself
+// or a secret:NAME reference, left to ResolveStoredSecrets.
+func ResolveSecret(secret string) (string, error) {
+	if name, ok := strings.CutPrefix(secret, secretEnvPrefix); ok {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	}
+	if path, ok := strings.CutPrefix(secret, secretFilePrefix); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	if command, ok := strings.CutPrefix(secret, secretCmdPrefix); ok {
+		out, err := exec.Command("sh", "-c", command).Output()
+		if err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+				return "", fmt.Errorf("command %q failed: %w: %s", command, err, strings.TrimSpace(string(exitErr.Stderr)))
+			}
+			return "", fmt.Errorf("command %q failed: %w", command, err)
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	}
+	return secret, nil
+}
+
+// secrets returns the secret fields of the user by name
+func (u *User) secrets() map[string]*string {
+	secrets := map[string]*string{
+		"caldav password": &u.CalDAV.Password,
+		"smtp password":   &u.SMTP.Password,
+		"imap password":   &u.IMAP.Password,
+	}
+	for service, conf := range map[string]*OAuth2{"caldav": u.CalDAV.OAuth2, "smtp": u.SMTP.OAuth2, "imap": u.IMAP.OAuth2} {
+		if conf != nil {
+			secrets[service+" oauth2 token"] = &conf.Token
+			secrets[service+" oauth2 refresh token"] = &conf.RefreshToken
+			secrets[service+" oauth2 client secret"] = &conf.ClientSecret
+		}
+	}
+	return secrets
+}
+
+// resolveSecrets replaces the secret references of the users with the secrets
+func (c *Config) resolveSecrets() error {
+	for i := range c.Users {
+		if err := c.Users[i].resolveSecrets(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveSecrets replaces the secret references of the user with the secrets
+func (u *User) resolveSecrets() error {
+	for name, secret := range u.secrets() {
+		value, err := ResolveSecret(*secret)
+		if err != nil {
+			return fmt.Errorf("user %s: failed resolving the %s: %w", u.Name, name, err)
+		}
+		*secret = value
+	}
+	return nil
+}
+
+// PlainSecrets returns the names of the secrets of the user which are held as is rather than
+// referenced
+func (u User) PlainSecrets() []string {
+	var names []string
+	for name, secret := range u.secrets() {
+		if *secret != "" && !isSecretReference(*secret) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithoutSecrets returns a copy of the user whose secrets held as is are masked
+func (u User) WithoutSecrets() User {
+	for _, conf := range []**OAuth2{&u.CalDAV.OAuth2, &u.SMTP.OAuth2, &u.IMAP.OAuth2} {
+		if *conf != nil {
+			copied := **conf
+			*conf = &copied
+		}
+	}
+	for _, secret := range u.secrets() {
+		if *secret != "" && !isSecretReference(*secret) {
+			*secret = "********"
+		}
+	}
+	return u
+}
+
+// ResolveStoredSecrets replaces the secret:NAME references of the users with the secrets lookup
+// returns. lookup is only called if there are such references.
+func (c *Config) ResolveStoredSecrets(lookup func(user, name string) (string, error)) error {
+	for i := range c.Users {
+		user := &c.Users[i]
+		for field, secret := range user.secrets() {
+			name, ok := strings.CutPrefix(*secret, secretStorePrefix)
+			if !ok {
+				continue
+			}
+			value, err := lookup(user.Name, name)
+			if err != nil {
+				return fmt.Errorf("user %s: failed reading the %s: %w", user.Name, field, err)
+			}
+			*secret = value
+		}
+	}
+	return nil
+}
+
+// checkPermissions refuses the config file at path if other users can read it while it holds
+// secrets, and warns if they can read it at all
+func (c *Config) checkPermissions(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0o044 == 0 {
+		return nil
+	}
+	for _, user := range c.Users {
+		if names := user.PlainSecrets(); len(names) > 0 {
+			return fmt.Errorf("config file %s is readable by other users (mode %v) and holds the %s of user %s. Run `chmod 600 %s` or use a secret reference like env:VAR",
+				path, info.Mode().Perm(), names[0], user.Name, path)
+		}
+	}
+	log.Printf("config file %s is readable by other users (mode %v), run `chmod 600 %s`", path, info.Mode().Perm(), path)
+	return nil
+}
@@ -1,28 +1,154 @@
 package config
 
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/nakamorg/calbridge/pkg/backend"
+)
+
 type User struct {
 	Name string `json:"name"`
 	// How often events and emails are checked, parsed as golang time. Ex: 30m, 1h, 3h etc
 	Frequency string `json:"frequency"`
-	CalDAV    struct {
-		URL      string `json:"url"`
-		Username string `json:"username"`
-		Password string `json:"password"`
-		// Number of upcoming days for which to read CalDAV events and send invitations.
-		EventDays int `json:"eventDays"`
-	} `json:"caldav"`
-	SMTP struct {
-		Host     string `json:"host"`
-		Username string `json:"username"`
-		Password string `json:"password"`
-	} `json:"smtp"`
-	IMAP struct {
-		Host     string `json:"host"`
-		Username string `json:"username"`
-		Password string `json:"password"`
-		// Number of past hours from which to read emails for calendar invites.
-		EmailHours int `json:"emailHours"`
-	} `json:"imap"`
+	CalDAV    CalDAV `json:"caldav"`
+	SMTP      SMTP   `json:"smtp"`
+	IMAP      IMAP   `json:"imap"`
+	// Do not sync the user
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+type CalDAV struct {
+	// URL of the calendar, or of the calendar home, of the user. If it is only a domain or the base
+	// URL of the server, like https://caldav.example.com/, the calendars are discovered.
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Authentication scheme: basic, digest, bearer (the password being the token) or none. By
+	// default the scheme is picked from the challenges of the server.
+	Auth string `json:"auth,omitempty"`
+	// Authenticate with OAuth2 bearer tokens instead of the password
+	OAuth2 *OAuth2 `json:"oauth2,omitempty"`
+	// Number of upcoming days for which to read CalDAV events and send invitations.
+	EventDays int `json:"eventDays"`
+	// Calendars, by display name or path, from which events are read. All the calendars are read
+	// if empty.
+	Calendars []string `json:"calendars,omitempty"`
+	// Calendar, by display name or path, to which imported invites are added. Defaults to the
+	// first of the read calendars.
+	ImportCalendar string `json:"importCalendar,omitempty"`
+}
+
+type SMTP struct {
+	Host     string `json:"host"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Authenticate with OAuth2 (XOAUTH2 or OAUTHBEARER) instead of the password
+	OAuth2 *OAuth2 `json:"oauth2,omitempty"`
+	Connection
+	// Directory with the templates of the emails, overriding the default ones. See pkg/email/templates.
+	TemplateDir string `json:"templateDir,omitempty"`
+	// Time zone, ex: Europe/Berlin, in which the event times are shown in the emails. Defaults to
+	// the time zone of the event.
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+type IMAP struct {
+	Host     string `json:"host"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Authenticate with OAuth2 (XOAUTH2 or OAUTHBEARER) instead of the password
+	OAuth2 *OAuth2 `json:"oauth2,omitempty"`
+	Connection
+	// Mailboxes to read calendar invites from. Defaults to INBOX.
+	Mailboxes []string `json:"mailboxes,omitempty"`
+	// What to do with the emails once their invites are added to the calendar
+	PostImport PostImport `json:"postImport,omitempty"`
+	// Number of past hours from which to read emails for calendar invites.
+	EmailHours int `json:"emailHours"`
+	// Keep a connection open and import invites as soon as they arrive, instead of only
+	// every Frequency. Only used by `calbridge run`.
+	Idle bool `json:"idle,omitempty"`
+}
+
+// PostImport lists the actions applied to the emails whose invites were imported
+type PostImport struct {
+	// IMAP keyword to set on the emails, ex: $CalbridgeImported. Emails having it are skipped.
+	Keyword string `json:"keyword,omitempty"`
+	// Mark the emails as read
+	MarkSeen bool `json:"markSeen,omitempty"`
+	// Mailbox to move the emails to
+	MoveTo string `json:"moveTo,omitempty"`
+	// Delete the emails. Can not be combined with MoveTo.
+	Delete bool `json:"delete,omitempty"`
+}
+
+// OAuth2 holds where the OAuth2 access tokens come from: a static Token, a RefreshToken exchanged
+// at TokenURL or a Command printing them. Exactly one of them is set.
+type OAuth2 struct {
+	// SASL mechanism of the mail servers: xoauth2 (Google, Microsoft) or oauthbearer. Defaults
+	// to xoauth2.
+	Mechanism string `json:"mechanism,omitempty"`
+	// Access token, for tokens which do not expire like app tokens
+	Token string `json:"token,omitempty"`
+	// Refresh token exchanged for access tokens at TokenURL. Refreshed tokens are kept in the data
+	// store.
+	RefreshToken string   `json:"refreshToken,omitempty"`
+	TokenURL     string   `json:"tokenUrl,omitempty"`
+	ClientID     string   `json:"clientId,omitempty"`
+	ClientSecret string   `json:"clientSecret,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+	// Shell command printing the access token, or a token response in json, on its standard output
+	Command string `json:"command,omitempty"`
+}
+
+// Connection holds how to connect to a mail server
+type Connection struct {
+	// Port of the server. Defaults to the well known port for the Security mode.
+	Port int `json:"port,omitempty"`
+	// Security is one of "tls" (implicit TLS), "starttls" or "plain" (no encryption, only for local
+	// testing). Defaults to "starttls" for SMTP and "tls" for IMAP.
+	Security string `json:"security,omitempty"`
+	// Path to a PEM file with the CA certificates to trust, for servers using self-signed certificates
+	CAFile string `json:"caFile,omitempty"`
+	// Do not verify the certificate of the server. Only meant for testing.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+}
+
+// TLSConfig returns the TLS config to connect to host with, or nil if the system defaults should be used
+func (c Connection) TLSConfig(host string) (*tls.Config, error) {
+	if c.CAFile == "" && !c.InsecureSkipVerify {
+		return nil, nil
+	}
+	conf := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading CA file: %w", err)
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", c.CAFile)
+		}
+	}
+	return conf, nil
+}
+
+// MailboxNames returns the mailboxes to read invites from
+func (i IMAP) MailboxNames() []string {
+	if len(i.Mailboxes) == 0 {
+		return []string{"INBOX"}
+	}
+	return i.Mailboxes
 }
 
 // LoadUsersFromConfig reads a json file containing calbridge user information and returns the Users
@@ -34,8 +160,97 @@ func LoadUsersFromConfig(path string) ([]User, error) {
 	return config.Users, err
 }
 
-// LoadUsersFromDB reads calbridge users info from db and returns
-func LoadUsersFromDB(path string) ([]User, error) {
+// LoadUsersFromDB returns the users stored in the db, with their secret references resolved. Users
+// which are invalid or whose secrets can not be resolved are logged and skipped.
+func LoadUsersFromDB(ctx context.Context, store backend.UserStore) ([]User, error) {
+	records, err := store.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
 	var users []User
+	for name, record := range records {
+		user, err := loadDBUser(name, record)
+		if err != nil {
+			// A broken user must not stop the others from syncing
+			log.Printf("skipping user %s of the db: %v", name, err)
+			continue
+		}
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
 	return users, nil
 }
+
+// loadDBUser decodes and validates the user stored in the db and resolves its secret references
+func loadDBUser(name string, record []byte) (User, error) {
+	user, err := decodeUser(name, record)
+	if err != nil {
+		return user, err
+	}
+	if problems := user.Validate(); len(problems) > 0 {
+		return user, &Error{File: "user " + name + " of the db", Problems: problems}
+	}
+	err = user.resolveSecrets()
+	return user, err
+}
+
+// GetUserFromDB returns the user named name as stored in the db, nil if there is none
+func GetUserFromDB(ctx context.Context, store backend.UserStore, name string) (*User, error) {
+	record, err := store.GetUser(ctx, name)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	user, err := decodeUser(name, record)
+	return &user, err
+}
+
+// PutUserToDB stores the user in the db, replacing the user of the same name
+func PutUserToDB(ctx context.Context, store backend.UserStore, user User) error {
+	if user.Name == "" {
+		return fmt.Errorf("user has no name")
+	}
+	record, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return store.PutUser(ctx, user.Name, record)
+}
+
+// decodeUser decodes the stored user named name
+func decodeUser(name string, record []byte) (User, error) {
+	var user User
+	if err := json.Unmarshal(record, &user); err != nil {
+		return user, fmt.Errorf("failed decoding stored user %s: %w", name, err)
+	}
+	user.Name = name
+	return user, nil
+}
+
+// MergeUsers returns the users of the config file and the users of the db. A user of the config
+// file takes precedence over the user of the same name in the db.
+func MergeUsers(fileUsers, dbUsers []User) []User {
+	users := append([]User{}, fileUsers...)
+	names := map[string]bool{}
+	for _, user := range fileUsers {
+		names[user.Name] = true
+	}
+	for _, user := range dbUsers {
+		if !names[user.Name] {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// EnabledUsers returns the users which are not disabled
+func EnabledUsers(users []User) []User {
+	var enabled []User
+	for _, user := range users {
+		if !user.Disabled {
+			enabled = append(enabled, user)
+		}
+	}
+	return enabled
+}
@@ -0,0 +1,239 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/nakamorg/calbridge/pkg/backend"
+)
+
+// Problem is an invalid field of the config
+type Problem struct {
+	// Line of the field in the config file, 0 if unknown
+	Line int
+	// Path of the field, ex: users[0].caldav.url
+	Field   string
+	Message string
+}
+
+func (p Problem) Error() string {
+	if p.Field == "" {
+		return p.Message
+	}
+	return p.Field + ": " + p.Message
+}
+
+// Error lists all the problems of a config file
+type Error struct {
+	File     string
+	Problems []Problem
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "invalid config %s:", e.File)
+	for _, p := range e.Problems {
+		b.WriteString("\n  ")
+		if p.Line > 0 {
+			fmt.Fprintf(&b, "%s:%d: ", e.File, p.Line)
+		}
+		b.WriteString(p.Error())
+	}
+	return b.String()
+}
+
+// Validate checks the user and returns all its problems, the fields of which are relative to the
+// user, ex: caldav.url
+func (u User) Validate() []Problem {
+	var problems []Problem
+	add := func(field, format string, args ...any) {
+		problems = append(problems, Problem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if u.Name == "" {
+		add("name", "is required")
+	} else if strings.IndexFunc(u.Name, unicode.IsControl) != -1 {
+		add("name", "must not contain control characters")
+	}
+	if u.Frequency == "" {
+		add("frequency", "is required, ex: 30m or 1h")
+	} else if d, err := time.ParseDuration(u.Frequency); err != nil {
+		add("frequency", "invalid duration %q, ex: 30m or 1h", u.Frequency)
+	} else if d <= 0 {
+		add("frequency", "must be positive")
+	}
+
+	if u.CalDAV.URL == "" {
+		add("caldav.url", "is required")
+	} else if err := validateServerURL(u.CalDAV.URL); err != nil {
+		add("caldav.url", "%v", err)
+	}
+	if u.CalDAV.EventDays <= 0 {
+		add("caldav.eventDays", "must be positive")
+	}
+	switch strings.ToLower(u.CalDAV.Auth) {
+	case "", "basic", "digest", "bearer", "none":
+	default:
+		add("caldav.auth", "must be one of basic, digest, bearer or none")
+	}
+	problems = append(problems, u.CalDAV.OAuth2.validate("caldav.oauth2")...)
+
+	problems = append(problems, validateServer("smtp", u.SMTP.Host, u.SMTP.Username, u.SMTP.Connection, u.SMTP.OAuth2)...)
+	if u.SMTP.TimeZone != "" {
+		if _, err := time.LoadLocation(u.SMTP.TimeZone); err != nil {
+			add("smtp.timeZone", "unknown time zone %q", u.SMTP.TimeZone)
+		}
+	}
+
+	problems = append(problems, validateServer("imap", u.IMAP.Host, u.IMAP.Username, u.IMAP.Connection, u.IMAP.OAuth2)...)
+	if u.IMAP.EmailHours <= 0 {
+		add("imap.emailHours", "must be positive")
+	}
+	for i, mailbox := range u.IMAP.Mailboxes {
+		if mailbox == "" {
+			add(fmt.Sprintf("imap.mailboxes[%d]", i), "is empty")
+		}
+	}
+	if u.IMAP.PostImport.Delete && u.IMAP.PostImport.MoveTo != "" {
+		add("imap.postImport", "delete can not be combined with moveTo")
+	}
+	return problems
+}
+
+// validateServerURL checks the URL of a server, which might also be a bare domain
+func validateServerURL(s string) error {
+	if !strings.Contains(s, "://") {
+		if strings.ContainsAny(s, " /") {
+			return fmt.Errorf("invalid URL %q, expected a URL like https://caldav.example.com/ or a domain", s)
+		}
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %v", s, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid URL %q, the scheme must be http or https", s)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid URL %q, the host is missing", s)
+	}
+	return nil
+}
+
+// validateServer checks the settings of a mail server
+func validateServer(prefix, host, username string, conn Connection, oauth2 *OAuth2) []Problem {
+	var problems []Problem
+	if host == "" {
+		problems = append(problems, Problem{Field: prefix + ".host", Message: "is required"})
+	} else if strings.ContainsAny(host, "/: ") {
+		problems = append(problems, Problem{Field: prefix + ".host", Message: fmt.Sprintf("invalid host %q, set the port with port", host)})
+	}
+	if username == "" {
+		problems = append(problems, Problem{Field: prefix + ".username", Message: "is required"})
+	}
+	if conn.Port < 0 || conn.Port > 65535 {
+		problems = append(problems, Problem{Field: prefix + ".port", Message: "must be between 1 and 65535"})
+	}
+	switch conn.Security {
+	case "", "tls", "starttls", "plain":
+	default:
+		problems = append(problems, Problem{Field: prefix + ".security", Message: "must be one of tls, starttls or plain"})
+	}
+	return append(problems, oauth2.validate(prefix+".oauth2")...)
+}
+
+// validate checks where the tokens come from
+func (o *OAuth2) validate(prefix string) []Problem {
+	if o == nil {
+		return nil
+	}
+	var problems []Problem
+	sources := 0
+	for _, source := range []string{o.Token, o.RefreshToken, o.Command} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		problems = append(problems, Problem{Field: prefix, Message: "exactly one of token, refreshToken or command must be set"})
+	}
+	if o.RefreshToken != "" {
+		if o.TokenURL == "" {
+			problems = append(problems, Problem{Field: prefix + ".tokenUrl", Message: "is required with refreshToken"})
+		} else if err := validateServerURL(o.TokenURL); err != nil || !strings.Contains(o.TokenURL, "://") {
+			problems = append(problems, Problem{Field: prefix + ".tokenUrl", Message: fmt.Sprintf("invalid URL %q", o.TokenURL)})
+		}
+	}
+	switch strings.ToLower(o.Mechanism) {
+	case "", "xoauth2", "oauthbearer":
+	default:
+		problems = append(problems, Problem{Field: prefix + ".mechanism", Message: "must be xoauth2 or oauthbearer"})
+	}
+	return problems
+}
+
+// validate checks the config and its users. The problems are located with lines, the line of
+// each field by path.
+func (c *Config) validate(lines map[string]int) []Problem {
+	var problems []Problem
+	if c.Concurrency < 0 {
+		problems = append(problems, Problem{Field: "concurrency", Message: "must not be negative"})
+	}
+	problems = append(problems, c.Storage.validate(nil)...)
+	names := map[string]bool{}
+	for i, user := range c.Users {
+		prefix := fmt.Sprintf("users[%d]", i)
+		if user.Name != "" && names[user.Name] {
+			problems = append(problems, Problem{Field: prefix + ".name", Message: fmt.Sprintf("duplicate user %s", user.Name)})
+		}
+		names[user.Name] = true
+		for _, p := range user.Validate() {
+			p.Field = prefix + "." + p.Field
+			problems = append(problems, p)
+		}
+	}
+	for i := range problems {
+		problems[i].Line = lineOf(problems[i].Field, lines)
+	}
+	return problems
+}
+
+// validate checks the type of the storage. The problems are located with lines, if not nil.
+func (s *Storage) validate(lines map[string]int) []Problem {
+	if s == nil {
+		return nil
+	}
+	switch s.Type {
+	case "", backend.TypeBolt, backend.TypeFile, backend.TypeSQLite, backend.TypeMemory:
+		return nil
+	}
+	message := fmt.Sprintf("must be one of %s, %s, %s or %s", backend.TypeBolt, backend.TypeFile, backend.TypeSQLite, backend.TypeMemory)
+	return []Problem{{Line: lineOf("storage.type", lines), Field: "storage.type", Message: message}}
+}
+
+// lineOf returns the line of the field, or of its closest parent if the field is not set
+func lineOf(field string, lines map[string]int) int {
+	for field != "" {
+		if line, ok := lines[field]; ok && line > 0 {
+			return line
+		}
+		i := strings.LastIndexAny(field, ".[")
+		if i == -1 {
+			break
+		}
+		field = field[:i]
+	}
+	return 0
+}
+
+// sortProblems orders the problems by line
+func sortProblems(problems []Problem) {
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Line < problems[j].Line
+	})
+}
@@ -0,0 +1,68 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"github.com/nakamorg/calbridge/pkg/oauth2"
+)
+
+// SASL mechanisms authenticating with an OAuth2 token
+const (
+	// MechanismXOAuth2 is the mechanism of Google and Microsoft
+	MechanismXOAuth2 = "xoauth2"
+	// MechanismOAuthBearer is the standard mechanism (RFC 7628)
+	MechanismOAuthBearer = "oauthbearer"
+)
+
+// Credentials of a mail account
+type Credentials struct {
+	Username string
+	Password string
+	// Tokens authenticate with OAuth2 instead of Password when set
+	Tokens oauth2.TokenSource
+	// Mechanism used with Tokens, MechanismXOAuth2 when empty
+	Mechanism string
+}
+
+// saslClient returns the SASL client authenticating with the credentials to the server. Passwords
+// are sent with the password mechanism.
+func (c Credentials) saslClient(ctx context.Context, server Server, password func(username, password string) sasl.Client) (sasl.Client, error) {
+	if c.Tokens == nil {
+		return password(c.Username, c.Password), nil
+	}
+	token, err := c.Tokens.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting the OAuth2 token: %w", err)
+	}
+	switch strings.ToLower(c.Mechanism) {
+	case "", MechanismXOAuth2:
+		return &xoauth2Client{username: c.Username, token: token}, nil
+	case MechanismOAuthBearer:
+		return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: c.Username,
+			Token:    token,
+			Host:     server.Host,
+			Port:     server.Port,
+		}), nil
+	}
+	return nil, fmt.Errorf("unsupported SASL mechanism %q", c.Mechanism)
+}
+
+// xoauth2Client implements the XOAUTH2 mechanism, see
+// https://developers.google.com/gmail/imap/xoauth2-protocol
+type xoauth2Client struct {
+	username, token string
+}
+
+func (c *xoauth2Client) Start() (string, []byte, error) {
+	return "XOAUTH2", []byte("user=" + c.username + "\x01auth=Bearer " + c.token + "\x01\x01"), nil
+}
+
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	// The server sends the details of a failure as a challenge, which is answered with an empty
+	// response to get the final error
+	return []byte{}, nil
+}
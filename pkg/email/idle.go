@@ -0,0 +1,121 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+const (
+	// Servers may log out clients which idle for more than 30 minutes (RFC 2177) so the IDLE
+	// command is restarted before that.
+	idleRestartInterval = 25 * time.Minute
+	// Wait time before reconnecting after the connection was lost. It doubles on each
+	// consecutive failure up to maxReconnectDelay.
+	minReconnectDelay = 5 * time.Second
+	maxReconnectDelay = 5 * time.Minute
+	// How long a watch has to run before its connection is deemed healthy and the reconnect
+	// delay starts from minReconnectDelay again
+	healthyWatchDuration = time.Minute
+)
+
+// WatchMailbox keeps a connection to the IMAP server open and calls onMail whenever new emails
+// arrive in the mailbox. It uses IDLE when the server supports it and otherwise polls the mailbox
+// every pollInterval. Connections are created with dial and re-created whenever they are lost.
+// WatchMailbox blocks until ctx is cancelled.
+func WatchMailbox(ctx context.Context, dial func() (*IMAPClient, error), mailbox string, pollInterval time.Duration, onMail func()) {
+	delay := minReconnectDelay
+	for {
+		c, err := dial()
+		if err == nil {
+			started := time.Now()
+			err = c.watch(ctx, mailbox, pollInterval, onMail)
+			c.Close()
+			// The connection was healthy for a while, start backing off from scratch. A watch
+			// failing right away, like on a failing SELECT, keeps backing off.
+			if time.Since(started) >= healthyWatchDuration {
+				delay = minReconnectDelay
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("lost connection watching %s, reconnecting in %v: %v", mailbox, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxReconnectDelay)
+	}
+}
+
+// watch idles on the mailbox and calls onMail when new emails arrive. It returns when ctx is
+// cancelled or the connection fails.
+func (c *IMAPClient) watch(ctx context.Context, mailbox string, pollInterval time.Duration, onMail func()) error {
+	updates := make(chan client.Update, 16)
+	c.c.Updates = updates
+	if _, err := c.c.Select(mailbox, true); err != nil {
+		return fmt.Errorf("failed to select %s: %v", mailbox, err)
+	}
+
+	// Updates have to be consumed all the time, otherwise the client blocks. We only care
+	// whether something arrived, so they are collapsed into a single pending signal.
+	newMail := make(chan struct{}, 1)
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case <-watchCtx.Done():
+				return
+			case update := <-updates:
+				if _, ok := update.(*client.MailboxUpdate); !ok {
+					continue
+				}
+				select {
+				case newMail <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	// Emails might have arrived while we were not connected
+	onMail()
+
+	opts := &client.IdleOptions{LogoutTimeout: idleRestartInterval, PollInterval: pollInterval}
+	for {
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			done <- c.c.Idle(stop, opts)
+		}()
+
+		select {
+		case <-ctx.Done():
+			close(stop)
+			<-done
+			return ctx.Err()
+		case err := <-done:
+			if err == nil {
+				err = fmt.Errorf("idle stopped unexpectedly")
+			}
+			return err
+		case <-newMail:
+			close(stop)
+			if err := <-done; err != nil {
+				return err
+			}
+		}
+		if c.c.State() == imap.LogoutState {
+			return fmt.Errorf("disconnected from server")
+		}
+		onMail()
+	}
+}
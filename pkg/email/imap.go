@@ -1,14 +1,17 @@
 package email
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"log"
 	"strings"
 	"time"
 
 	"github.com/emersion/go-ical"
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
 	"github.com/emersion/go-message/mail"
 	"github.com/emersion/go-sasl"
 )
@@ -18,16 +21,45 @@ type IMAPClient struct {
 	c        *client.Client
 }
 
-func NewIMAPClient(username, password, host, port string) (*IMAPClient, error) {
-	c, err := client.DialTLS(fmt.Sprintf("%s:%s", host, port), nil)
+// NewIMAPClient connects to the IMAP server and logs in with the credentials, using SASL PLAIN
+// for passwords
+func NewIMAPClient(ctx context.Context, creds Credentials, server Server) (*IMAPClient, error) {
+	var c *client.Client
+	var err error
+	if server.Security == "" {
+		server.Security = SecurityTLS
+	}
+	addr := server.addr(143, 993, 143)
+	switch server.Security {
+	case SecurityTLS:
+		c, err = client.DialTLS(addr, server.TLSConfig)
+	case SecurityStartTLS:
+		if c, err = client.Dial(addr); err == nil {
+			if err = c.StartTLS(server.TLSConfig); err != nil {
+				c.Logout()
+			}
+		}
+	case SecurityPlain:
+		c, err = client.Dial(addr)
+	default:
+		return nil, fmt.Errorf("unsupported security mode %q", server.Security)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to IMAP server: %v", err)
 	}
-	if err := c.Authenticate(sasl.NewPlainClient("", username, password)); err != nil {
+	auth, err := creds.saslClient(ctx, server, func(username, password string) sasl.Client {
+		return sasl.NewPlainClient("", username, password)
+	})
+	if err != nil {
+		c.Logout()
+		return nil, err
+	}
+	if err := c.Authenticate(auth); err != nil {
+		c.Logout()
 		return nil, fmt.Errorf("failed to login to IMAP server: %v", err)
 	}
 	return &IMAPClient{
-		username: username,
+		username: creds.Username,
 		c:        c,
 	}, nil
 }
@@ -36,53 +68,297 @@ func (c *IMAPClient) Close() {
 	c.c.Logout()
 }
 
-func (c *IMAPClient) ReadCalendarInvites(hours int) ([]*ical.Calendar, error) {
+// Noop checks that the connection to the IMAP server is still usable
+func (c *IMAPClient) Noop() error {
+	return c.c.Noop()
+}
+
+// MailboxState tracks which emails of a mailbox were already read. UIDs are only meaningful
+// as long as the UIDVALIDITY of the mailbox does not change.
+type MailboxState struct {
+	UIDValidity uint32 `json:"uidValidity"`
+	LastUID     uint32 `json:"lastUid"`
+}
+
+// InviteEmail is an email containing calendar invites
+type InviteEmail struct {
+	UID     uint32
+	Invites []*ical.Calendar
+}
+
+// PostImportActions are applied to the emails once their invites are imported
+type PostImportActions struct {
+	// Keyword to set on the emails, ex: $CalbridgeImported. Emails having it are not read again.
+	Keyword string
+	// Mark the emails as Seen
+	MarkSeen bool
+	// Move the emails to this mailbox
+	MoveTo string
+	// Delete the emails. Can not be combined with MoveTo.
+	Delete bool
+}
+
+// ReadCalendarInvites returns the emails with calendar invites in mailbox which arrived after
+// the ones recorded in state, along with the new state to record once the invites are processed.
+// If the state is empty or the UIDVALIDITY of the mailbox changed, the emails sent within the
+// past hours are read instead. Emails having skipKeyword set are ignored.
+func (c *IMAPClient) ReadCalendarInvites(mailbox string, state MailboxState, hours int, skipKeyword string) ([]InviteEmail, MailboxState, error) {
 	client := c.c
 
-	// Select the INBOX mailbox
-	if _, err := client.Select("INBOX", false); err != nil {
-		return nil, fmt.Errorf("failed to select INBOX: %v", err)
+	mbox, err := client.Select(mailbox, false)
+	if err != nil {
+		return nil, state, fmt.Errorf("failed to select %s: %v", mailbox, err)
 	}
 
-	// Calculate the time range for the last n hours
-	since := time.Now().Add(-time.Duration(hours) * time.Hour)
 	criteria := imap.NewSearchCriteria()
-	criteria.SentSince = since
+	if state.UIDValidity != 0 && state.UIDValidity == mbox.UidValidity {
+		criteria.Uid = new(imap.SeqSet)
+		criteria.Uid.AddRange(state.LastUID+1, 0)
+	} else {
+		// Calculate the time range for the last n hours
+		criteria.SentSince = time.Now().Add(-time.Duration(hours) * time.Hour)
+	}
+	if skipKeyword != "" {
+		criteria.WithoutFlags = []string{skipKeyword}
+	}
 
-	// Search for emails within the time range
-	seqNums, err := client.Search(criteria)
+	newState := MailboxState{UIDValidity: mbox.UidValidity, LastUID: state.LastUID}
+	if mbox.UidValidity != state.UIDValidity {
+		newState.LastUID = 0
+	}
+	if mbox.UidNext > 0 {
+		newState.LastUID = max(newState.LastUID, mbox.UidNext-1)
+	}
+
+	// Search for new emails
+	found, err := client.UidSearch(criteria)
 	if err != nil {
-		return nil, fmt.Errorf("failed to search emails: %v", err)
+		return nil, state, fmt.Errorf("failed to search emails: %v", err)
+	}
+	var uids []uint32
+	for _, uid := range found {
+		// `n:*` always matches the last email even if its UID is less than n
+		if criteria.Uid != nil && uid <= state.LastUID {
+			continue
+		}
+		uids = append(uids, uid)
+		newState.LastUID = max(newState.LastUID, uid)
 	}
-	if len(seqNums) == 0 {
-		return nil, nil
+	if len(uids) == 0 {
+		return nil, newState, nil
+	}
+
+	// Only download the emails which have a calendar part
+	if uids, err = c.uidsWithCalendar(uids); err != nil {
+		return nil, state, err
+	}
+	if len(uids) == 0 {
+		return nil, newState, nil
 	}
 
 	// We want to fetch `BODY.PEEK[]`, peek to prevent marking the emails as `Seen`.
 	section := &imap.BodySectionName{Peek: true}
-	items := []imap.FetchItem{section.FetchItem()}
-	msgs := make(chan *imap.Message, len(seqNums))
+	items := []imap.FetchItem{imap.FetchUid, section.FetchItem()}
+	msgs := make(chan *imap.Message, len(uids))
 	seqSet := new(imap.SeqSet)
-	seqSet.AddNum(seqNums...)
-	if err := client.Fetch(seqSet, items, msgs); err != nil {
-		return nil, fmt.Errorf("failed to fetch email: %v", err)
+	seqSet.AddNum(uids...)
+	if err := client.UidFetch(seqSet, items, msgs); err != nil {
+		return nil, state, fmt.Errorf("failed to fetch email: %v", err)
 	}
 
-	var invites []*ical.Calendar
+	var emails []InviteEmail
 	for msg := range msgs {
 		if msg == nil {
 			continue
 		}
+		inviteEmail := InviteEmail{UID: msg.Uid}
+		var err error
 		for _, bodySection := range msg.Body {
-			msgInvites, err := extractCalendarInvites(bodySection)
-			if err != nil {
-				return invites, err
+			var msgInvites []*ical.Calendar
+			if msgInvites, err = extractCalendarInvites(bodySection); err != nil {
+				break
 			}
-			invites = append(invites, msgInvites...)
+			inviteEmail.Invites = append(inviteEmail.Invites, msgInvites...)
+		}
+		// A malformed email is skipped for good, it would otherwise be read again on every sync
+		if err != nil {
+			log.Printf("skipping email %d of %s: %v", msg.Uid, mailbox, err)
+			continue
+		}
+		emails = append(emails, inviteEmail)
+	}
+	return emails, newState, nil
+}
+
+// ApplyPostImportActions applies the actions to the emails with the given UIDs in mailbox
+func (c *IMAPClient) ApplyPostImportActions(mailbox string, uids []uint32, actions PostImportActions) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	if actions.MoveTo != "" && actions.Delete {
+		return fmt.Errorf("emails can either be moved or deleted, not both")
+	}
+	client := c.c
 
+	mbox, err := c.selectWritable(mailbox)
+	if err != nil {
+		return err
+	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+
+	var flags []interface{}
+	if actions.Keyword != "" {
+		if canStoreKeyword(mbox, actions.Keyword) {
+			flags = append(flags, actions.Keyword)
+		} else {
+			log.Printf("%s does not allow setting the %s keyword, skipping it", mailbox, actions.Keyword)
 		}
 	}
-	return invites, nil
+	if actions.MarkSeen {
+		flags = append(flags, imap.SeenFlag)
+	}
+	if len(flags) != 0 {
+		item := imap.FormatFlagsOp(imap.AddFlags, true)
+		if err := client.UidStore(seqSet, item, flags, nil); err != nil {
+			return fmt.Errorf("failed to set flags on emails: %v", err)
+		}
+	}
+
+	switch {
+	case actions.MoveTo != "":
+		canMove, err := client.Support("MOVE")
+		if err != nil {
+			return err
+		}
+		if canMove {
+			if err := client.UidMove(seqSet, actions.MoveTo); err != nil {
+				return fmt.Errorf("failed to move emails to %s: %v", actions.MoveTo, err)
+			}
+			return nil
+		}
+		// The emails are copied then deleted, go-imap's own fallback would expunge the whole mailbox
+		if err := client.UidCopy(seqSet, actions.MoveTo); err != nil {
+			return fmt.Errorf("failed to copy emails to %s: %v", actions.MoveTo, err)
+		}
+		if err := c.delete(mailbox, seqSet); err != nil {
+			return err
+		}
+	case actions.Delete:
+		if err := c.delete(mailbox, seqSet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NeedsOrganizerKeyword is set on the emails holding scheduling messages, like COUNTER, which only
+// the organizer can handle
+const NeedsOrganizerKeyword = "$CalbridgeNeedsOrganizer"
+
+// FlagForOrganizer flags the emails with the given UIDs in mailbox, and sets NeedsOrganizerKeyword
+// on them if the mailbox allows it, so that the organizer notices the scheduling messages they hold
+// and handles them in their email client
+func (c *IMAPClient) FlagForOrganizer(mailbox string, uids []uint32) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	mbox, err := c.selectWritable(mailbox)
+	if err != nil {
+		return err
+	}
+	flags := []interface{}{imap.FlaggedFlag}
+	if canStoreKeyword(mbox, NeedsOrganizerKeyword) {
+		flags = append(flags, NeedsOrganizerKeyword)
+	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := c.c.UidStore(seqSet, item, flags, nil); err != nil {
+		return fmt.Errorf("failed to flag emails for the organizer: %v", err)
+	}
+	return nil
+}
+
+// selectWritable selects mailbox in read-write mode, unless it already is
+func (c *IMAPClient) selectWritable(mailbox string) (*imap.MailboxStatus, error) {
+	mbox := c.c.Mailbox()
+	if mbox != nil && mbox.Name == mailbox && !mbox.ReadOnly {
+		return mbox, nil
+	}
+	mbox, err := c.c.Select(mailbox, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select %s: %v", mailbox, err)
+	}
+	return mbox, nil
+}
+
+// delete flags the emails of seqSet, which holds UIDs, as deleted and expunges them with UID
+// EXPUNGE. A plain EXPUNGE would also remove the other emails the user flagged as deleted, so if
+// the server does not support UIDPLUS the emails are only flagged.
+func (c *IMAPClient) delete(mailbox string, seqSet *imap.SeqSet) error {
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := c.c.UidStore(seqSet, item, []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return fmt.Errorf("failed to mark emails as deleted: %v", err)
+	}
+	if ok, err := c.c.Support("UIDPLUS"); err != nil {
+		return err
+	} else if !ok {
+		log.Printf("the server of %s does not support UIDPLUS, the emails are left flagged as deleted in %s", c.username, mailbox)
+		return nil
+	}
+	cmd := &commands.Uid{Cmd: &imap.Command{Name: "EXPUNGE", Arguments: []interface{}{seqSet}}}
+	status, err := c.c.Execute(cmd, nil)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to expunge emails: %v", err)
+	}
+	return nil
+}
+
+// canStoreKeyword reports whether the keyword can be permanently set on the emails of the mailbox
+func canStoreKeyword(mbox *imap.MailboxStatus, keyword string) bool {
+	// Servers which don't announce the permanent flags allow all of them
+	if len(mbox.PermanentFlags) == 0 {
+		return true
+	}
+	for _, flag := range mbox.PermanentFlags {
+		if flag == imap.TryCreateFlag || strings.EqualFold(flag, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// uidsWithCalendar fetches the body structure of the emails and returns the UIDs of the ones
+// having a text/calendar part
+func (c *IMAPClient) uidsWithCalendar(uids []uint32) ([]uint32, error) {
+	msgs := make(chan *imap.Message, len(uids))
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+	if err := c.c.UidFetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchBodyStructure}, msgs); err != nil {
+		return nil, fmt.Errorf("failed to fetch email structure: %v", err)
+	}
+
+	var withCalendar []uint32
+	for msg := range msgs {
+		if msg == nil || msg.BodyStructure == nil {
+			continue
+		}
+		hasCalendar := false
+		msg.BodyStructure.Walk(func(path []int, part *imap.BodyStructure) bool {
+			if strings.EqualFold(part.MIMEType, "text") && strings.EqualFold(part.MIMESubType, "calendar") {
+				hasCalendar = true
+			}
+			return !hasCalendar
+		})
+		if hasCalendar {
+			withCalendar = append(withCalendar, msg.Uid)
+		}
+	}
+	return withCalendar, nil
 }
 
 func extractCalendarInvites(bodySection imap.Literal) ([]*ical.Calendar, error) {
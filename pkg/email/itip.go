@@ -0,0 +1,112 @@
+package email
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/nakamorg/calbridge/pkg/util"
+)
+
+const productID = "-//nakamorg//calbridge//EN"
+
+// cancellation returns an iTIP CANCEL message (RFC 5546 section 3.2.5) for the whole event in cal,
+// addressed to the attendees
+func cancellation(cal *ical.Calendar, attendees []string, sequence int) (*ical.Calendar, error) {
+	master := masterEvent(cal)
+	if master == nil {
+		return nil, fmt.Errorf("calendar has no events")
+	}
+
+	event := ical.NewEvent()
+	for _, name := range []string{ical.PropUID, ical.PropOrganizer, ical.PropDateTimeStart, ical.PropDateTimeEnd,
+		ical.PropDuration, ical.PropRecurrenceRule, ical.PropSummary, ical.PropLocation} {
+		if props := master.Props.Values(name); len(props) != 0 {
+			event.Props[name] = props
+		}
+	}
+	for _, attendee := range attendees {
+		event.Props.Add(attendeeProp(master, attendee))
+	}
+	event.Props.SetText(ical.PropSequence, fmt.Sprint(sequence))
+	event.Props.SetDateTime(ical.PropDateTimeStamp, time.Now().UTC())
+	event.Props.SetText(ical.PropStatus, string(ical.EventCancelled))
+
+	msg := newITIPCalendar("CANCEL", cal)
+	msg.Children = append(msg.Children, event.Component)
+	return msg, nil
+}
+
+// reply returns an iTIP REPLY message (RFC 5546 section 3.2.3) for the events in cal, having
+// only the ATTENDEE property of address
+func reply(cal *ical.Calendar, address string) (*ical.Calendar, error) {
+	msg := newITIPCalendar("REPLY", cal)
+	for _, e := range cal.Events() {
+		attendee := findAttendee(&e, address)
+		if attendee == nil {
+			continue
+		}
+		event := ical.NewEvent()
+		for _, name := range []string{ical.PropUID, ical.PropRecurrenceID, ical.PropOrganizer, ical.PropDateTimeStart,
+			ical.PropDateTimeEnd, ical.PropDuration, ical.PropSequence, ical.PropSummary} {
+			if props := e.Props.Values(name); len(props) != 0 {
+				event.Props[name] = props
+			}
+		}
+		event.Props.Add(attendee)
+		event.Props.SetDateTime(ical.PropDateTimeStamp, time.Now().UTC())
+		msg.Children = append(msg.Children, event.Component)
+	}
+	if len(msg.Events()) == 0 {
+		return nil, fmt.Errorf("%s is not an attendee of the event", address)
+	}
+	return msg, nil
+}
+
+// newITIPCalendar returns an empty iTIP message with method, having the time zones of cal
+func newITIPCalendar(method string, cal *ical.Calendar) *ical.Calendar {
+	msg := ical.NewCalendar()
+	msg.Props.SetText(ical.PropVersion, "2.0")
+	msg.Props.SetText(ical.PropProductID, productID)
+	msg.Props.SetText(ical.PropMethod, method)
+	for _, child := range cal.Children {
+		if child.Name == ical.CompTimezone {
+			msg.Children = append(msg.Children, child)
+		}
+	}
+	return msg
+}
+
+// masterEvent returns the master event of cal, see util.MasterEvent, or the first event if all of
+// them are overridden instances, which share the properties the emails are built from
+func masterEvent(cal *ical.Calendar) *ical.Event {
+	if master := util.MasterEvent(cal); master != nil {
+		return master
+	}
+	if events := cal.Events(); len(events) != 0 {
+		return &events[0]
+	}
+	return nil
+}
+
+// attendeeProp returns the ATTENDEE property of the event for address, or a new one if the
+// address is not an attendee of the event anymore
+func attendeeProp(event *ical.Event, address string) *ical.Prop {
+	if prop := findAttendee(event, address); prop != nil {
+		return prop
+	}
+	prop := ical.NewProp(ical.PropAttendee)
+	prop.Value = "mailto:" + address
+	return prop
+}
+
+// findAttendee returns the ATTENDEE property of the event for address or nil if there is none
+func findAttendee(event *ical.Event, address string) *ical.Prop {
+	for _, prop := range event.Props.Values(ical.PropAttendee) {
+		if strings.EqualFold(strings.TrimPrefix(strings.ToLower(prop.Value), "mailto:"), address) {
+			return &prop
+		}
+	}
+	return nil
+}
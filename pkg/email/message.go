@@ -0,0 +1,110 @@
+package email
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-message/mail"
+)
+
+// buildMessage returns the email carrying the iTIP message cal. The email is a multipart/alternative
+// with a text, an html and a text/calendar part, which makes mail clients show their RSVP buttons,
+// and the calendar is also attached as an .ics file for the clients which don't.
+func buildMessage(from string, to []string, subject, text, html, method string, cal *ical.Calendar) ([]byte, error) {
+	cal = withMethod(cal, method)
+	var ics bytes.Buffer
+	if err := ical.NewEncoder(&ics).Encode(cal); err != nil {
+		return nil, err
+	}
+
+	var h mail.Header
+	h.SetDate(time.Now())
+	h.SetAddressList("From", []*mail.Address{{Address: from}})
+	var toAddrs []*mail.Address
+	for _, addr := range to {
+		toAddrs = append(toAddrs, &mail.Address{Address: addr})
+	}
+	h.SetAddressList("To", toAddrs)
+	h.SetSubject(subject)
+	if err := h.GenerateMessageIDWithHostname(domain(from)); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	mw, err := mail.CreateWriter(&buf, h)
+	if err != nil {
+		return nil, err
+	}
+	iw, err := mw.CreateInline()
+	if err != nil {
+		return nil, err
+	}
+	parts := []struct {
+		contentType string
+		params      map[string]string
+		content     []byte
+	}{
+		{"text/plain", map[string]string{"charset": "utf-8"}, []byte(text)},
+		{"text/html", map[string]string{"charset": "utf-8"}, []byte(html)},
+		{"text/calendar", map[string]string{"charset": "utf-8", "method": method}, ics.Bytes()},
+	}
+	for _, part := range parts {
+		var ph mail.InlineHeader
+		ph.SetContentType(part.contentType, part.params)
+		if err := writePart(func() (io.WriteCloser, error) { return iw.CreatePart(ph) }, part.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := iw.Close(); err != nil {
+		return nil, err
+	}
+
+	var ah mail.AttachmentHeader
+	ah.SetContentType("application/ics", map[string]string{"name": "invite.ics"})
+	ah.SetFilename("invite.ics")
+	if err := writePart(func() (io.WriteCloser, error) { return mw.CreateAttachment(ah) }, ics.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writePart(create func() (io.WriteCloser, error), content []byte) error {
+	w, err := create()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// withMethod returns a shallow copy of cal with the METHOD property set to method, as the iTIP
+// message must have the same method as its text/calendar part. cal is left untouched.
+func withMethod(cal *ical.Calendar, method string) *ical.Calendar {
+	props := make(ical.Props, len(cal.Props)+1)
+	for name, values := range cal.Props {
+		props[name] = values
+	}
+	props.SetText(ical.PropMethod, method)
+	return &ical.Calendar{Component: &ical.Component{
+		Name:     cal.Name,
+		Props:    props,
+		Children: cal.Children,
+	}}
+}
+
+// domain returns the domain part of the email address, used to generate unique message ids
+func domain(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return address[i+1:]
+	}
+	return "localhost"
+}
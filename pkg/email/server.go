@@ -0,0 +1,48 @@
+package email
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+)
+
+// Security is how the connection to a mail server is secured
+type Security string
+
+const (
+	// SecurityTLS connects using implicit TLS, usually on ports 465 (SMTP) and 993 (IMAP)
+	SecurityTLS Security = "tls"
+	// SecurityStartTLS connects in plain text and upgrades the connection using STARTTLS,
+	// usually on ports 587 (SMTP) and 143 (IMAP)
+	SecurityStartTLS Security = "starttls"
+	// SecurityPlain does not encrypt the connection. Only meant for local testing.
+	SecurityPlain Security = "plain"
+)
+
+// Server holds the address of a mail server and how to connect to it
+type Server struct {
+	Host string
+	// Port defaults to the well known port of the protocol for the Security mode when 0
+	Port int
+	// Security defaults to STARTTLS for SMTP and TLS for IMAP when empty
+	Security Security
+	// TLSConfig is used for the TLS and STARTTLS modes. The system defaults are used when nil.
+	TLSConfig *tls.Config
+}
+
+// addr returns the host:port address of the server, picking the default port for the
+// security mode when the port is not set
+func (s Server) addr(startTLSPort, tlsPort, plainPort int) string {
+	port := s.Port
+	if port == 0 {
+		switch s.Security {
+		case SecurityStartTLS:
+			port = startTLSPort
+		case SecurityTLS:
+			port = tlsPort
+		case SecurityPlain:
+			port = plainPort
+		}
+	}
+	return net.JoinHostPort(s.Host, strconv.Itoa(port))
+}
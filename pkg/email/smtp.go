@@ -2,8 +2,8 @@ package email
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"strings"
 
 	"github.com/emersion/go-ical"
 	sasl "github.com/emersion/go-sasl"
@@ -12,20 +12,51 @@ import (
 )
 
 type SMTPClient struct {
-	from string
-	c    *smtp.Client
+	from      string
+	c         *smtp.Client
+	templates *Templates
 }
 
-func NewSMTPClient(username, password, host, port string) (*SMTPClient, error) {
-	smtpServer := fmt.Sprintf("%s:%s", host, port)
-	c, err := smtp.DialStartTLS(smtpServer, nil)
+// NewSMTPClient connects to the SMTP server and logs in with the credentials, using SASL LOGIN
+// for passwords
+func NewSMTPClient(ctx context.Context, creds Credentials, server Server) (*SMTPClient, error) {
+	var c *smtp.Client
+	var err error
+	if server.Security == "" {
+		server.Security = SecurityStartTLS
+	}
+	addr := server.addr(587, 465, 25)
+	switch server.Security {
+	case SecurityStartTLS:
+		c, err = smtp.DialStartTLS(addr, server.TLSConfig)
+	case SecurityTLS:
+		c, err = smtp.DialTLS(addr, server.TLSConfig)
+	case SecurityPlain:
+		c, err = smtp.Dial(addr)
+	default:
+		return nil, fmt.Errorf("unsupported security mode %q", server.Security)
+	}
+	if err != nil {
+		return nil, err
+	}
+	auth, err := creds.saslClient(ctx, server, sasl.NewLoginClient)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := c.Auth(auth); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to login to SMTP server: %v", err)
+	}
+	templates, err := LoadTemplates("", nil)
 	if err != nil {
+		c.Close()
 		return nil, err
 	}
-	c.Auth(sasl.NewLoginClient(username, password))
 	return &SMTPClient{
-		from: username,
-		c:    c,
+		from:      creds.Username,
+		c:         c,
+		templates: templates,
 	}, nil
 }
 
@@ -33,44 +64,96 @@ func (c *SMTPClient) Close() {
 	c.c.Close()
 }
 
-// SendCalendarInvite sends calendar invite to all the attendees using email. Invites are not sent
-// if the calendar organizer and the email sender does not match
+// Noop checks that the connection to the SMTP server is still usable
+func (c *SMTPClient) Noop() error {
+	return c.c.Noop()
+}
+
+// SendCalendarInvite sends calendar invite to all the attendees who have not responded yet using
+// email. Invites are not sent if the calendar organizer and the email sender does not match
 func (c *SMTPClient) SendCalendarInvite(cal *ical.Calendar) error {
-	from := c.from
-	if !isOrganizer(cal, from) {
+	return c.SendCalendarInviteTo(cal, attendees(cal))
+}
+
+// SendCalendarInviteTo sends calendar invite to the attendees in to. Invites are not sent if the
+// calendar organizer and the email sender does not match
+func (c *SMTPClient) SendCalendarInviteTo(cal *ical.Calendar, to []string) error {
+	if !isOrganizer(cal, c.from) || len(to) == 0 {
 		return nil
 	}
-	to := attendees(cal)
-	if len(to) == 0 {
+	return c.sendCalendar(to, TemplateInvite, "REQUEST", cal, c.templates.templateData(cal))
+}
+
+// SendCalendarUpdate sends the updated event in cal to the attendees in to, listing the changes
+// made to the event. The SEQUENCE of the event must have been incremented for the attendees to
+// apply the update. Updates are not sent if the calendar organizer and the email sender does not match
+func (c *SMTPClient) SendCalendarUpdate(cal *ical.Calendar, to []string, changes []string) error {
+	if !isOrganizer(cal, c.from) || len(to) == 0 {
+		return nil
+	}
+	data := c.templates.templateData(cal)
+	data.Changes = changes
+	return c.sendCalendar(to, TemplateUpdate, "REQUEST", cal, data)
+}
+
+// SendCalendarCancel sends a cancellation (METHOD:CANCEL) of the event in cal to the attendees in
+// to. sequence must be greater than the SEQUENCE of the invites sent before. Nothing is sent if the
+// calendar organizer and the email sender does not match.
+func (c *SMTPClient) SendCalendarCancel(cal *ical.Calendar, to []string, sequence int) error {
+	if !isOrganizer(cal, c.from) || len(to) == 0 {
 		return nil
 	}
+	cancel, err := cancellation(cal, to, sequence)
+	if err != nil {
+		return err
+	}
+	return c.sendCalendar(to, TemplateCancel, "CANCEL", cancel, c.templates.templateData(cal))
+}
 
-	var buf bytes.Buffer
-	if err := ical.NewEncoder(&buf).Encode(cal); err != nil {
+// SendCalendarReply sends the participation status of the email sender, as an iTIP REPLY, to the
+// organizer of the event in cal
+func (c *SMTPClient) SendCalendarReply(cal *ical.Calendar) error {
+	var organizers []string
+	for organizer := range util.EventOrganizers(cal) {
+		organizers = append(organizers, organizer)
+	}
+	if len(organizers) == 0 {
+		return fmt.Errorf("event has no organizer to reply to")
+	}
+	msg, err := reply(cal, c.from)
+	if err != nil {
 		return err
 	}
+	data := c.templates.templateData(cal)
+	data.Sender = c.from
+	data.Status = statusText(util.EventAttendees(cal)[c.from])
+	return c.sendCalendar(organizers, TemplateReply, "REPLY", msg, data)
+}
 
-	headers := make(map[string]string)
-	headers["From"] = from
-	headers["To"] = strings.Join(to, ",")
-	headers["Subject"] = subject(cal)
-	headers["MIME-Version"] = "1.0"
-	headers["Content-Type"] = "multipart/mixed; boundary=\"boundary\""
+// IsOrganizer reports whether the email sender is the organizer of the event in cal
+func (c *SMTPClient) IsOrganizer(cal *ical.Calendar) bool {
+	return isOrganizer(cal, c.from)
+}
 
-	var msg string
-	for k, v := range headers {
-		msg += fmt.Sprintf("%s: %s\r\n", k, v)
-	}
-	msg += "\r\n--boundary\r\n"
-	msg += "Content-Type: text/plain; charset=utf-8\r\n\r\n"
-	msg += "Please find the attached calendar invite.\r\n"
-	msg += "\r\n--boundary\r\n"
-	msg += "Content-Type: text/calendar; method=REQUEST; charset=utf-8\r\n"
-	msg += "Content-Disposition: attachment; filename=\"invite.ics\"\r\n\r\n"
-	msg += buf.String()
-	msg += "\r\n--boundary--\r\n"
+// SetTemplates sets the templates used to render the emails. The default templates are used
+// until this is called.
+func (c *SMTPClient) SetTemplates(templates *Templates) {
+	c.templates = templates
+}
 
-	return c.c.SendMail(from, to, strings.NewReader(msg))
+// sendCalendar emails cal, as an iTIP message with method, to the recipients in to. The email
+// is rendered by the templates of kind using data.
+func (c *SMTPClient) sendCalendar(to []string, kind, method string, cal *ical.Calendar, data TemplateData) error {
+	data.Sender = c.from
+	subject, text, html, err := c.templates.render(kind, data)
+	if err != nil {
+		return fmt.Errorf("failed rendering %s email: %v", kind, err)
+	}
+	msg, err := buildMessage(c.from, to, subject, text, html, method, cal)
+	if err != nil {
+		return err
+	}
+	return c.c.SendMail(c.from, to, bytes.NewReader(msg))
 }
 
 func attendees(cal *ical.Calendar) []string {
@@ -90,8 +173,17 @@ func isOrganizer(cal *ical.Calendar, user string) bool {
 	return ok
 }
 
-func subject(cal *ical.Calendar) string {
-	subject := "Invitation"
-	summary := util.EventSummary(cal)
-	return subject + ": " + summary
+// statusText returns the participation status for humans
+func statusText(status string) string {
+	switch status {
+	case "ACCEPTED":
+		return "Accepted"
+	case "DECLINED":
+		return "Declined"
+	case "TENTATIVE":
+		return "Tentative"
+	case "DELEGATED":
+		return "Delegated"
+	}
+	return "Updated"
 }
@@ -0,0 +1,246 @@
+package email
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/nakamorg/calbridge/pkg/util"
+	"github.com/teambition/rrule-go"
+)
+
+// Kinds of emails, each having its own templates
+const (
+	TemplateInvite = "invite"
+	TemplateUpdate = "update"
+	TemplateCancel = "cancel"
+	TemplateReply  = "reply"
+)
+
+//go:embed templates
+var defaultTemplates embed.FS
+
+var templateFuncs = map[string]any{
+	"join": strings.Join,
+}
+
+// Templates render the subject and the bodies of the emails. Each kind of email has a text
+// template, <kind>.txt, defining the "subject" and "text" templates and an html template,
+// <kind>.html, defining the "html" template.
+type Templates struct {
+	text map[string]*texttemplate.Template
+	html map[string]*htmltemplate.Template
+	// Times are shown in this location
+	location *time.Location
+}
+
+// TemplateData is what the templates are executed with
+type TemplateData struct {
+	Summary     string
+	Description string
+	Location    string
+	// Start and End of the event in the time zone of the templates, or of the event if the
+	// templates have none
+	Start time.Time
+	End   time.Time
+	// When is Start and End formatted for humans
+	When string
+	// Repeats describes the recurrence of a recurring event for humans, empty for single events
+	Repeats   string
+	Organizer string
+	Attendees []string
+	// Changes made to the event, only set for updates
+	Changes []string
+	// Sender of the email and, for replies, the participation status they replied with
+	Sender string
+	Status string
+}
+
+// LoadTemplates returns the templates in dir, falling back to the default ones for the files
+// missing from dir. If dir is empty the default templates are used. Times are shown in loc, or in
+// the time zone of the event if loc is nil.
+func LoadTemplates(dir string, loc *time.Location) (*Templates, error) {
+	t := &Templates{
+		text:     map[string]*texttemplate.Template{},
+		html:     map[string]*htmltemplate.Template{},
+		location: loc,
+	}
+	for _, kind := range []string{TemplateInvite, TemplateUpdate, TemplateCancel, TemplateReply} {
+		content, err := readTemplate(dir, kind+".txt")
+		if err != nil {
+			return nil, err
+		}
+		if t.text[kind], err = texttemplate.New(kind).Funcs(templateFuncs).Parse(content); err != nil {
+			return nil, fmt.Errorf("failed parsing %s.txt template: %w", kind, err)
+		}
+
+		if content, err = readTemplate(dir, kind+".html"); err != nil {
+			return nil, err
+		}
+		if t.html[kind], err = htmltemplate.New(kind).Funcs(templateFuncs).Parse(content); err != nil {
+			return nil, fmt.Errorf("failed parsing %s.html template: %w", kind, err)
+		}
+	}
+	return t, nil
+}
+
+func readTemplate(dir, name string) (string, error) {
+	if dir != "" {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			return string(content), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+	content, err := defaultTemplates.ReadFile("templates/" + name)
+	return string(content), err
+}
+
+// render returns the subject, text and html body of the email of kind
+func (t *Templates) render(kind string, data TemplateData) (subject, text, html string, err error) {
+	var buf bytes.Buffer
+	if err = t.text[kind].ExecuteTemplate(&buf, "subject", data); err != nil {
+		return
+	}
+	// Subjects can not span multiple lines
+	subject = strings.Join(strings.Fields(buf.String()), " ")
+
+	buf.Reset()
+	if err = t.text[kind].ExecuteTemplate(&buf, "text", data); err != nil {
+		return
+	}
+	text = buf.String()
+
+	buf.Reset()
+	if err = t.html[kind].ExecuteTemplate(&buf, "html", data); err != nil {
+		return
+	}
+	html = buf.String()
+	return
+}
+
+// templateData returns the data of the event in cal to execute the templates with
+func (t *Templates) templateData(cal *ical.Calendar) TemplateData {
+	var data TemplateData
+	master := masterEvent(cal)
+	if master == nil {
+		return data
+	}
+	data.Summary, _ = master.Props.Text(ical.PropSummary)
+	data.Description, _ = master.Props.Text(ical.PropDescription)
+	data.Location, _ = master.Props.Text(ical.PropLocation)
+
+	loc := t.location
+	if loc == nil {
+		loc = eventLocation(master)
+	}
+	data.Start, _ = master.DateTimeStart(loc)
+	data.End, _ = master.DateTimeEnd(loc)
+	data.When = formatWhen(data.Start.In(loc), data.End.In(loc), isAllDay(master))
+	data.Repeats = formatRepeats(master, loc)
+
+	for organizer := range util.EventOrganizers(cal) {
+		data.Organizer = organizer
+	}
+	for attendee := range util.EventAttendees(cal) {
+		data.Attendees = append(data.Attendees, attendee)
+	}
+	slices.Sort(data.Attendees)
+	return data
+}
+
+// eventLocation returns the time zone of the start of the event, UTC if it has none or it's unknown
+func eventLocation(event *ical.Event) *time.Location {
+	if prop := event.Props.Get(ical.PropDateTimeStart); prop != nil {
+		if tzid := prop.Params.Get(ical.ParamTimezoneID); tzid != "" {
+			if loc, err := time.LoadLocation(tzid); err == nil {
+				return loc
+			}
+		}
+	}
+	return time.UTC
+}
+
+func isAllDay(event *ical.Event) bool {
+	prop := event.Props.Get(ical.PropDateTimeStart)
+	return prop != nil && prop.ValueType() == ical.ValueDate
+}
+
+func formatWhen(start, end time.Time, allDay bool) string {
+	if start.IsZero() {
+		return ""
+	}
+	if allDay {
+		// The end of all day events is exclusive
+		if end.IsZero() || !end.AddDate(0, 0, -1).After(start) {
+			return start.Format("Mon Jan 2, 2006")
+		}
+		return start.Format("Mon Jan 2, 2006") + " - " + end.AddDate(0, 0, -1).Format("Mon Jan 2, 2006")
+	}
+	when := start.Format("Mon Jan 2, 2006 15:04")
+	switch {
+	case end.IsZero():
+	case end.YearDay() == start.YearDay() && end.Year() == start.Year():
+		when += " - " + end.Format("15:04")
+	default:
+		when += " - " + end.Format("Mon Jan 2, 2006 15:04")
+	}
+	return when + " (" + start.Location().String() + ")"
+}
+
+// formatRepeats describes the RRULE of the event, ex: "Every 2 weeks, until Mon Jan 2, 2006"
+func formatRepeats(event *ical.Event, loc *time.Location) string {
+	roption, err := event.Props.RecurrenceRule()
+	if err != nil || roption == nil {
+		if event.Props.Get(ical.PropRecurrenceDates) != nil {
+			return "On several dates"
+		}
+		return ""
+	}
+	units := map[rrule.Frequency]string{
+		rrule.YEARLY:   "year",
+		rrule.MONTHLY:  "month",
+		rrule.WEEKLY:   "week",
+		rrule.DAILY:    "day",
+		rrule.HOURLY:   "hour",
+		rrule.MINUTELY: "minute",
+		rrule.SECONDLY: "second",
+	}
+	repeats := "Every " + units[roption.Freq]
+	if roption.Interval > 1 {
+		repeats = fmt.Sprintf("Every %d %ss", roption.Interval, units[roption.Freq])
+	}
+	if len(roption.Byweekday) != 0 {
+		var days []string
+		for _, day := range roption.Byweekday {
+			// rrule weeks start on Monday
+			name := time.Weekday((day.Day() + 1) % 7).String()[:3]
+			if n := day.N(); n != 0 {
+				name = fmt.Sprintf("%s (%+d)", name, n)
+			}
+			days = append(days, name)
+		}
+		repeats += " on " + strings.Join(days, ", ")
+	}
+	switch {
+	case roption.Count == 1:
+		repeats += ", once"
+	case roption.Count > 1:
+		repeats += fmt.Sprintf(", %d times", roption.Count)
+	case !roption.Until.IsZero():
+		repeats += ", until " + roption.Until.In(loc).Format("Mon Jan 2, 2006")
+	}
+	return repeats
+}
@@ -0,0 +1,144 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/nakamorg/calbridge/pkg/oauth2"
+)
+
+// Authentication schemes of the HTTP clients
+const (
+	AuthBasic  = "basic"
+	AuthDigest = "digest"
+	AuthBearer = "bearer"
+	// AuthNone sends the requests without credentials
+	AuthNone = "none"
+)
+
+type bearerAuthHTTPClient struct {
+	c      HTTPClient
+	tokens oauth2.TokenSource
+}
+
+// HTTPClientWithBearerAuth returns an HTTP client that adds a bearer token
+// (RFC 6750) of tokens to all outgoing requests. If c is nil,
+// http.DefaultClient is used.
+func HTTPClientWithBearerAuth(c HTTPClient, tokens oauth2.TokenSource) HTTPClient {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	return &bearerAuthHTTPClient{c, tokens}
+}
+
+func (c *bearerAuthHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	token, err := c.tokens.Token(req.Context())
+	if err != nil {
+		return nil, fmt.Errorf("failed getting the bearer token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return c.c.Do(req)
+}
+
+type negotiatingHTTPClient struct {
+	c                  HTTPClient
+	username, password string
+
+	mu sync.Mutex
+	// Client of the negotiated scheme, nil until the server asked for credentials
+	negotiated HTTPClient
+}
+
+// HTTPClientWithAuth returns an HTTP client that authenticates the outgoing
+// requests with scheme, one of AuthBasic, AuthDigest, AuthBearer (password
+// being the token) or AuthNone. If scheme is empty, the scheme is negotiated:
+// requests are sent without credentials until the server answers with a 401
+// and then with the strongest scheme its WWW-Authenticate challenges offer,
+// Digest being preferred over Basic and Basic over Bearer. If c is nil,
+// http.DefaultClient is used.
+func HTTPClientWithAuth(c HTTPClient, scheme, username, password string) (HTTPClient, error) {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	switch strings.ToLower(scheme) {
+	case "":
+		return &negotiatingHTTPClient{c: c, username: username, password: password}, nil
+	case AuthBasic:
+		return HTTPClientWithBasicAuth(c, username, password), nil
+	case AuthDigest:
+		return HTTPClientWithDigestAuth(c, username, password), nil
+	case AuthBearer:
+		return HTTPClientWithBearerAuth(c, oauth2.StaticTokenSource(password)), nil
+	case AuthNone:
+		return c, nil
+	}
+	return nil, fmt.Errorf("unsupported authentication scheme %q", scheme)
+}
+
+func (c *negotiatingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	negotiated := c.negotiated
+	c.mu.Unlock()
+	if negotiated != nil {
+		return negotiated.Do(req)
+	}
+
+	// The body is sent again once the scheme is known
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.c.Do(withBody(req, body))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	negotiated, err = c.negotiate(resp.Header.Values(authHeader))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	c.mu.Lock()
+	c.negotiated = negotiated
+	c.mu.Unlock()
+	return negotiated.Do(withBody(req, body))
+}
+
+// negotiate returns the client of the strongest scheme offered by the challenges
+func (c *negotiatingHTTPClient) negotiate(headers []string) (HTTPClient, error) {
+	offered := map[string]bool{}
+	for _, ch := range parseChallenges(headers) {
+		offered[ch.scheme] = true
+	}
+	switch {
+	case offered[AuthDigest]:
+		challenge, err := selectDigestChallenge(headers)
+		if err != nil {
+			return nil, err
+		}
+		// The challenge at hand is answered right away
+		return &digestAuthHTTPClient{c: c.c, username: c.username, password: c.password, challenge: challenge}, nil
+	case offered[AuthBasic]:
+		return HTTPClientWithBasicAuth(c.c, c.username, c.password), nil
+	case offered[AuthBearer]:
+		return HTTPClientWithBearerAuth(c.c, oauth2.StaticTokenSource(c.password)), nil
+	}
+	return nil, fmt.Errorf("server asked for an unsupported authentication scheme: %s", strings.Join(headers, "; "))
+}
+
+// withBody returns a copy of the request sending body
+func withBody(req *http.Request, body []byte) *http.Request {
+	newReq := req.Clone(req.Context())
+	if body != nil {
+		newReq.Body = io.NopCloser(bytes.NewReader(body))
+		newReq.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	return newReq
+}
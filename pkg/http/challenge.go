@@ -0,0 +1,79 @@
+package http
+
+import (
+	"strings"
+)
+
+// challenge is an authentication challenge of a WWW-Authenticate header (RFC 9110 section 11.6.1)
+type challenge struct {
+	// Lower cased scheme, ex: digest
+	scheme string
+	// Parameters by their lower cased name
+	params map[string]string
+}
+
+// parseChallenges returns the challenges of the WWW-Authenticate headers. A header might hold
+// several comma separated challenges, ex: `Basic realm="x", Digest realm="x", qop="auth,auth-int"`.
+func parseChallenges(headers []string) []challenge {
+	var challenges []challenge
+	for _, header := range headers {
+		s := header
+		for {
+			s = strings.TrimLeft(s, " \t,")
+			if s == "" {
+				break
+			}
+			var token string
+			token, s = readToken(s)
+			if token == "" {
+				// Not a token, skip the offending character
+				s = s[1:]
+				continue
+			}
+			rest := strings.TrimLeft(s, " \t")
+			if !strings.HasPrefix(rest, "=") || len(challenges) == 0 {
+				challenges = append(challenges, challenge{scheme: strings.ToLower(token), params: map[string]string{}})
+				continue
+			}
+
+			// A parameter of the last challenge
+			rest = strings.TrimLeft(rest[1:], " \t")
+			var value string
+			if strings.HasPrefix(rest, `"`) {
+				value, s = readQuoted(rest)
+			} else {
+				value, s = readToken(rest)
+			}
+			challenges[len(challenges)-1].params[strings.ToLower(token)] = value
+		}
+	}
+	return challenges
+}
+
+// readToken returns the token at the start of s and the rest of s
+func readToken(s string) (string, string) {
+	i := strings.IndexAny(s, " \t,=;\"")
+	if i == -1 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+// readQuoted returns the unescaped value of the quoted string at the start of s and the rest of s
+func readQuoted(s string) (string, string) {
+	var value strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				value.WriteByte(s[i])
+			}
+		case '"':
+			return value.String(), s[i+1:]
+		default:
+			value.WriteByte(s[i])
+		}
+	}
+	return value.String(), ""
+}
@@ -1,12 +1,18 @@
 package http
 
 import (
-	"context"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
+	"slices"
 	"strings"
+	"sync"
 )
 
 const (
@@ -20,6 +26,12 @@ type HTTPClient interface {
 type digestAuthHTTPClient struct {
 	c                  HTTPClient
 	username, password string
+
+	mu sync.Mutex
+	// Last challenge of the server, used to authenticate the requests preemptively
+	challenge *digestChallenge
+	// Number of requests sent with the nonce of challenge
+	nonceCount uint32
 }
 
 type basicAuthHTTPClient struct {
@@ -42,87 +54,222 @@ func (c *basicAuthHTTPClient) Do(req *http.Request) (*http.Response, error) {
 	return c.c.Do(req)
 }
 
-// HTTPClientWithDigestAuth returns an HTTP client that adds basic
-// authentication to all outgoing requests. If c is nil, http.DefaultClient is
+// HTTPClientWithDigestAuth returns an HTTP client that adds digest
+// authentication (RFC 7616) to all outgoing requests. The challenge of the
+// server is reused for the subsequent requests, which are authenticated
+// without waiting for another challenge. If c is nil, http.DefaultClient is
 // used.
 func HTTPClientWithDigestAuth(c HTTPClient, username, password string) HTTPClient {
 	if c == nil {
 		c = http.DefaultClient
 	}
-	return &digestAuthHTTPClient{c, username, password}
+	return &digestAuthHTTPClient{c: c, username: username, password: password}
 }
 
 func (c *digestAuthHTTPClient) Do(req *http.Request) (*http.Response, error) {
-	// We need to copy the request body
-	var reqBody io.ReadCloser
-	if req.Body != nil {
-		reqBody, _ = req.GetBody()
+	// The body is sent again after the challenge and hashed for auth-int
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
 	}
-	resp, err := c.c.Do(req)
+
+	c.mu.Lock()
+	cached := c.challenge
+	c.mu.Unlock()
+
+	resp, err := c.send(req, body, cached)
 	if err != nil {
 		return resp, err
 	}
-	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
 
-	if resp.StatusCode == http.StatusUnauthorized {
-		challenge := resp.Header.Get(authHeader)
-		if len(challenge) == 0 {
-			return resp, fmt.Errorf("empty challenge header")
+	challenge, err := selectDigestChallenge(resp.Header.Values(authHeader))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if cached != nil && !challenge.stale && challenge.nonce == cached.nonce {
+		// The credentials were rejected, there is no point in retrying
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	c.mu.Lock()
+	c.challenge, c.nonceCount = challenge, 0
+	c.mu.Unlock()
+	return c.send(req, body, challenge)
+}
+
+// send sends the request with body, authenticated with the challenge if it is not nil
+func (c *digestAuthHTTPClient) send(req *http.Request, body []byte, challenge *digestChallenge) (*http.Response, error) {
+	newReq := withBody(req, body)
+	if challenge != nil {
+		authorization, err := c.authorization(challenge, req.Method, req.URL.RequestURI(), body)
+		if err != nil {
+			return nil, err
 		}
-		digestAuthorization := digestHeader(c.username, c.password, req.Method, req.URL.String(), challenge)
-		// Create a new request with the same URL and body as the original request
-		newReq := req.Clone(context.Background())
-		newReq.Body = reqBody
-		newReq.Header.Set("Authorization", digestAuthorization)
-		return http.DefaultClient.Do(newReq)
-	}
-	return nil, fmt.Errorf("server did not support digest auth. Response code: %v", resp.StatusCode)
-}
-
-func digestHeader(username, password, method, uri, challenge string) string {
-	fields := parseDigestChallenge(challenge)
-
-	realm := fields["realm"]
-	nonce := fields["nonce"]
-	qop := fields["qop"]
-	opaque := fields["opaque"]
-	algorithm := fields["algorithm"]
-
-	// Using fixed cnonce. We should generate some random nonce though
-	cnonce := "0a4f113b"
-	// Generate nc (nonce count)
-	nc := "00000001"
-
-	ha1 := getMD5(username + ":" + realm + ":" + password)
-	ha2 := getMD5(method + ":" + uri)
-	response := getMD5(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
-
-	// Construct the Authorization header
-	authorization := fmt.Sprintf("Digest username=%q,realm=%q,nonce=%q,uri=%q,cnonce=%q,nc=%q,qop=%q,response=%q,opaque=%q,algorithm=%q",
-		username, realm, nonce, uri, cnonce, nc, qop, response, opaque, algorithm)
-	return authorization
-}
-
-func parseDigestChallenge(challenge string) map[string]string {
-	result := make(map[string]string)
-
-	// Remove the "Digest " prefix
-	challenge = strings.TrimPrefix(challenge, "Digest ")
-
-	// Split the challenge into key-value pairs
-	pairs := strings.Split(challenge, ",")
-	for _, pair := range pairs {
-		parts := strings.SplitN(pair, "=", 2)
-		if len(parts) == 2 {
-			key := strings.TrimSpace(parts[0])
-			value := strings.Trim(parts[1], "\"")
-			result[key] = value
+		newReq.Header.Set("Authorization", authorization)
+	}
+	return c.c.Do(newReq)
+}
+
+// authorization returns the Authorization header answering the challenge for the request
+func (c *digestAuthHTTPClient) authorization(challenge *digestChallenge, method, uri string, body []byte) (string, error) {
+	c.mu.Lock()
+	c.nonceCount++
+	nc := fmt.Sprintf("%08x", c.nonceCount)
+	c.mu.Unlock()
+
+	cnonce, err := newCnonce()
+	if err != nil {
+		return "", err
+	}
+	h := challenge.hash
+
+	ha1 := h(c.username + ":" + challenge.realm + ":" + c.password)
+	if challenge.session {
+		ha1 = h(ha1 + ":" + challenge.nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+	if challenge.qop == "auth-int" {
+		ha2 = h(method + ":" + uri + ":" + h(string(body)))
+	}
+	var response string
+	if challenge.qop == "" {
+		// RFC 2069 compatibility
+		response = h(ha1 + ":" + challenge.nonce + ":" + ha2)
+	} else {
+		response = h(ha1 + ":" + challenge.nonce + ":" + nc + ":" + cnonce + ":" + challenge.qop + ":" + ha2)
+	}
+
+	username := c.username
+	if challenge.userhash {
+		username = h(c.username + ":" + challenge.realm)
+	}
+	params := []string{
+		fmt.Sprintf("username=%q", username),
+		fmt.Sprintf("realm=%q", challenge.realm),
+		fmt.Sprintf("nonce=%q", challenge.nonce),
+		fmt.Sprintf("uri=%q", uri),
+		fmt.Sprintf("response=%q", response),
+		"algorithm=" + challenge.algorithm,
+	}
+	if challenge.qop != "" {
+		params = append(params, "qop="+challenge.qop, "nc="+nc, fmt.Sprintf("cnonce=%q", cnonce))
+	}
+	if challenge.opaque != "" {
+		params = append(params, fmt.Sprintf("opaque=%q", challenge.opaque))
+	}
+	if challenge.userhash {
+		params = append(params, "userhash=true")
+	}
+	return "Digest " + strings.Join(params, ", "), nil
+}
+
+// digestChallenge is a Digest challenge of the server
+type digestChallenge struct {
+	realm, nonce, opaque string
+	// Algorithm as named by the server, ex: SHA-256-sess
+	algorithm string
+	hash      func(string) string
+	// Whether the algorithm is a -sess variant
+	session bool
+	// Chosen quality of protection, empty if the server did not offer any
+	qop      string
+	userhash bool
+	// Whether the previous nonce was rejected only because it expired
+	stale bool
+}
+
+type digestAlgorithm struct {
+	name string
+	hash func() hash.Hash
+}
+
+// digestAlgorithms are the supported algorithms, strongest first
+var digestAlgorithms = []digestAlgorithm{
+	{"SHA-512-256", sha512.New512_256},
+	{"SHA-256", sha256.New},
+	{"MD5", md5.New},
+}
+
+// selectDigestChallenge returns the Digest challenge with the strongest supported algorithm
+func selectDigestChallenge(headers []string) (*digestChallenge, error) {
+	if len(headers) == 0 {
+		return nil, fmt.Errorf("empty challenge header")
+	}
+	var selected *digestChallenge
+	rank := len(digestAlgorithms)
+	for _, ch := range parseChallenges(headers) {
+		if ch.scheme != "digest" {
+			continue
+		}
+		algorithm := ch.params["algorithm"]
+		if algorithm == "" {
+			algorithm = "MD5"
+		}
+		name, session := strings.CutSuffix(strings.ToUpper(algorithm), "-SESS")
+		i := slices.IndexFunc(digestAlgorithms, func(a digestAlgorithm) bool {
+			return a.name == name
+		})
+		if i == -1 || i >= rank {
+			continue
 		}
+		rank = i
+
+		newHash := digestAlgorithms[i].hash
+		selected = &digestChallenge{
+			realm:     ch.params["realm"],
+			nonce:     ch.params["nonce"],
+			opaque:    ch.params["opaque"],
+			algorithm: algorithm,
+			hash: func(s string) string {
+				h := newHash()
+				h.Write([]byte(s))
+				return hex.EncodeToString(h.Sum(nil))
+			},
+			session:  session,
+			qop:      selectQop(ch.params["qop"]),
+			userhash: strings.EqualFold(ch.params["userhash"], "true"),
+			stale:    strings.EqualFold(ch.params["stale"], "true"),
+		}
+	}
+	if selected == nil {
+		return nil, fmt.Errorf("server did not offer a supported digest challenge: %s", strings.Join(headers, "; "))
+	}
+	return selected, nil
+}
+
+// selectQop returns the quality of protection to use among the offered ones, auth is preferred
+// as not all servers hash the body the same way for auth-int
+func selectQop(offered string) string {
+	var qops []string
+	for _, qop := range strings.Split(offered, ",") {
+		qops = append(qops, strings.ToLower(strings.TrimSpace(qop)))
 	}
-	return result
+	for _, qop := range []string{"auth", "auth-int"} {
+		if slices.Contains(qops, qop) {
+			return qop
+		}
+	}
+	return ""
+}
+
+// readBody reads the body of the request, nil if it has none
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	defer req.Body.Close()
+	return io.ReadAll(req.Body)
 }
 
-func getMD5(text string) string {
-	hash := md5.Sum([]byte(text))
-	return fmt.Sprintf("%x", hash)
+func newCnonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
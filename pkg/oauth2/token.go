@@ -0,0 +1,208 @@
+package oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// expiryDelta is how long before its expiry a token is considered expired, so that it does not
+	// expire while in use
+	expiryDelta = time.Minute
+	// commandTokenTTL is how long the token printed by a command is used when it does not tell
+	// when it expires
+	commandTokenTTL = 5 * time.Minute
+)
+
+// refreshClient refreshes the tokens. A hung token endpoint must not block the syncs of the user
+// forever.
+var refreshClient = &http.Client{Timeout: 30 * time.Second}
+
+// Token is an OAuth2 access token
+type Token struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken,omitempty"`
+	// Zero if the token does not expire
+	Expiry time.Time `json:"expiry,omitempty"`
+}
+
+// Valid reports whether the token is set and not about to expire
+func (t Token) Valid() bool {
+	return t.AccessToken != "" && (t.Expiry.IsZero() || time.Now().Add(expiryDelta).Before(t.Expiry))
+}
+
+// TokenSource returns the access tokens to authenticate with. Implementations must be safe for
+// concurrent use.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+type staticTokenSource string
+
+// StaticTokenSource returns a TokenSource always returning token
+func StaticTokenSource(token string) TokenSource {
+	return staticTokenSource(token)
+}
+
+func (s staticTokenSource) Token(ctx context.Context) (string, error) {
+	return string(s), nil
+}
+
+// RefreshConfig is the OAuth2 client exchanging refresh tokens for access tokens (RFC 6749
+// section 6)
+type RefreshConfig struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+}
+
+type refreshTokenSource struct {
+	conf RefreshConfig
+	save func(ctx context.Context, token Token) error
+
+	mu    sync.Mutex
+	token Token
+}
+
+// RefreshTokenSource returns a TokenSource using token until it expires and then exchanging its
+// refresh token for a new one at the token endpoint of conf. The new tokens, which might come with
+// a new refresh token, are passed to save. save may be nil.
+func RefreshTokenSource(conf RefreshConfig, token Token, save func(ctx context.Context, token Token) error) TokenSource {
+	return &refreshTokenSource{conf: conf, save: save, token: token}
+}
+
+func (s *refreshTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token.Valid() {
+		return s.token.AccessToken, nil
+	}
+	if s.token.RefreshToken == "" {
+		return "", fmt.Errorf("no refresh token")
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.token.RefreshToken},
+		"client_id":     {s.conf.ClientID},
+	}
+	if s.conf.ClientSecret != "" {
+		form.Set("client_secret", s.conf.ClientSecret)
+	}
+	if len(s.conf.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.conf.Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.conf.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := refreshClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed refreshing the token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("failed reading the token response: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("failed refreshing the token: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	token, err := parseTokenResponse(body)
+	if err != nil {
+		return "", err
+	}
+	if token.RefreshToken == "" {
+		// The refresh token is only sent again when it is rotated
+		token.RefreshToken = s.token.RefreshToken
+	}
+	s.token = token
+	if s.save != nil {
+		if err := s.save(ctx, token); err != nil {
+			return "", fmt.Errorf("failed saving the refreshed token: %w", err)
+		}
+	}
+	return token.AccessToken, nil
+}
+
+type commandTokenSource struct {
+	command string
+
+	mu    sync.Mutex
+	token Token
+}
+
+// CommandTokenSource returns a TokenSource running command with the shell to get the tokens. The
+// command prints either the access token or a token response in json, like the token endpoints
+// return, on its standard output. Printed access tokens are used for commandTokenTTL, tokens of a
+// response until they expire.
+func CommandTokenSource(command string) TokenSource {
+	return &commandTokenSource{command: command}
+}
+
+func (s *commandTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token.Valid() {
+		return s.token.AccessToken, nil
+	}
+
+	out, err := exec.CommandContext(ctx, "sh", "-c", s.command).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("token command failed: %w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("token command failed: %w", err)
+	}
+	output := strings.TrimSpace(string(out))
+	if output == "" {
+		return "", fmt.Errorf("token command printed no token")
+	}
+	token := Token{AccessToken: output, Expiry: time.Now().Add(commandTokenTTL)}
+	if strings.HasPrefix(output, "{") {
+		if token, err = parseTokenResponse(out); err != nil {
+			return "", err
+		}
+		if token.Expiry.IsZero() {
+			token.Expiry = time.Now().Add(commandTokenTTL)
+		}
+	}
+	s.token = token
+	return token.AccessToken, nil
+}
+
+// parseTokenResponse returns the token of a successful token response (RFC 6749 section 5.1)
+func parseTokenResponse(body []byte) (Token, error) {
+	var resp struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		Error        string `json:"error"`
+		Description  string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return Token{}, fmt.Errorf("failed decoding the token response: %w", err)
+	}
+	if resp.Error != "" {
+		return Token{}, fmt.Errorf("token error %s: %s", resp.Error, resp.Description)
+	}
+	if resp.AccessToken == "" {
+		return Token{}, fmt.Errorf("no access token in the token response")
+	}
+	token := Token{AccessToken: resp.AccessToken, RefreshToken: resp.RefreshToken}
+	if resp.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
@@ -0,0 +1,196 @@
+package secrets
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/nakamorg/calbridge/pkg/backend"
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// version is the first byte of the encrypted secrets, followed by the nonce and the sealed
+	// secret. The key of the vault is followed by its salt, the nonce and the sealed verifier.
+	version  = 1
+	saltSize = 16
+	keySize  = 32
+
+	// Argon2id parameters, as recommended by RFC 9106 for memory constrained environments
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+)
+
+const (
+	// vaultUser and vaultKeyName name the secret holding the salt of the key of the vault and a
+	// verifier sealed with it. User names can not contain control characters so vaultUser never
+	// clashes with a user.
+	vaultUser    = "\x00vault"
+	vaultKeyName = "key"
+)
+
+// verifier is sealed with the key of the vault to check the passphrase or key file before
+// reading or writing any secret
+var verifier = []byte("calbridge secrets")
+
+// ErrWrongKey is returned when a secret can not be decrypted with the passphrase or key file
+var ErrWrongKey = errors.New("wrong passphrase or key file")
+
+// Vault encrypts the secrets of the users with a key derived from a passphrase or the content of
+// a key file and keeps them in a backend.SecretStore. The key is derived once, with the salt
+// stored along with the secrets.
+type Vault struct {
+	store    backend.SecretStore
+	material []byte
+
+	mu sync.Mutex
+	// Cipher of the derived key, nil until the key is derived as deriving it is slow on purpose
+	aead cipher.AEAD
+}
+
+// NewVault returns a Vault keeping the secrets in store, encrypted with a key derived from
+// passphrase
+func NewVault(store backend.SecretStore, passphrase string) *Vault {
+	return &Vault{store: store, material: []byte(passphrase)}
+}
+
+// NewVaultFromKeyFile returns a Vault keeping the secrets in store, encrypted with a key derived
+// from the content of the key file at path
+func NewVaultFromKeyFile(store backend.SecretStore, path string) (*Vault, error) {
+	material, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading key file: %w", err)
+	}
+	if len(material) == 0 {
+		return nil, fmt.Errorf("key file %s is empty", path)
+	}
+	return &Vault{store: store, material: material}, nil
+}
+
+// Get returns the secret of the user named name and whether there is one
+func (v *Vault) Get(ctx context.Context, user, name string) (string, bool, error) {
+	sealed, err := v.store.GetSecret(ctx, user, name)
+	if err != nil || sealed == nil {
+		return "", false, err
+	}
+	aead, err := v.cipher(ctx, false)
+	if err != nil {
+		return "", false, err
+	}
+	if len(sealed) < 1+aead.NonceSize() || sealed[0] != version {
+		return "", false, fmt.Errorf("secret %s of %s has an unknown format", name, user)
+	}
+	nonce, sealed := sealed[1:1+aead.NonceSize()], sealed[1+aead.NonceSize():]
+	secret, err := aead.Open(nil, nonce, sealed, additionalData(user, name))
+	if err != nil {
+		return "", false, ErrWrongKey
+	}
+	return string(secret), true, nil
+}
+
+// Set encrypts and stores the secret of the user named name. The first secret stored sets the
+// passphrase or key file of the vault, the others must use the same one.
+func (v *Vault) Set(ctx context.Context, user, name, secret string) error {
+	aead, err := v.cipher(ctx, true)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := append([]byte{version}, nonce...)
+	sealed = aead.Seal(sealed, nonce, []byte(secret), additionalData(user, name))
+	return v.store.PutSecret(ctx, user, name, sealed)
+}
+
+// Remove deletes the secret of the user named name
+func (v *Vault) Remove(ctx context.Context, user, name string) error {
+	return v.store.DeleteSecret(ctx, user, name)
+}
+
+// cipher returns the AES-GCM cipher of the key of the vault, derived with the stored salt and
+// checked against the stored verifier. If the vault has no key yet, one is created if create is
+// set.
+func (v *Vault) cipher(ctx context.Context, create bool) (cipher.AEAD, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.aead != nil {
+		return v.aead, nil
+	}
+
+	stored, err := v.store.GetSecret(ctx, vaultUser, vaultKeyName)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		if !create {
+			return nil, fmt.Errorf("the secret store has no key, store the secrets again with `calbridge secrets set`")
+		}
+		return v.createKey(ctx)
+	}
+
+	if len(stored) < 1+saltSize || stored[0] != version {
+		return nil, fmt.Errorf("the key of the secret store has an unknown format")
+	}
+	aead, err := v.deriveCipher(stored[1 : 1+saltSize])
+	if err != nil {
+		return nil, err
+	}
+	stored = stored[1+saltSize:]
+	if len(stored) < aead.NonceSize() {
+		return nil, fmt.Errorf("the key of the secret store is truncated")
+	}
+	nonce, sealed := stored[:aead.NonceSize()], stored[aead.NonceSize():]
+	if _, err := aead.Open(nil, nonce, sealed, []byte(vaultKeyName)); err != nil {
+		return nil, ErrWrongKey
+	}
+	v.aead = aead
+	return aead, nil
+}
+
+// createKey derives the key of the vault with a new salt and stores the salt along with the
+// sealed verifier
+func (v *Vault) createKey(ctx context.Context) (cipher.AEAD, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := v.deriveCipher(salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	stored := append([]byte{version}, salt...)
+	stored = append(stored, nonce...)
+	stored = aead.Seal(stored, nonce, verifier, []byte(vaultKeyName))
+	if err := v.store.PutSecret(ctx, vaultUser, vaultKeyName, stored); err != nil {
+		return nil, err
+	}
+	v.aead = aead
+	return aead, nil
+}
+
+// deriveCipher returns the AES-GCM cipher with the key derived for salt
+func (v *Vault) deriveCipher(salt []byte) (cipher.AEAD, error) {
+	key := argon2.IDKey(v.material, salt, argonTime, argonMemory, argonThreads, keySize)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// additionalData binds a sealed secret to its user and name so that it can not be moved to another
+func additionalData(user, name string) []byte {
+	return []byte(user + "\x00" + name)
+}
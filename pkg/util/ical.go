@@ -8,22 +8,29 @@ import (
 	"github.com/emersion/go-ical"
 )
 
-// EventUid returns the UID of calendar event. If the cal object doesn't have exactly
-// one event and one UID prop an error is returned.
+// EventUid returns the UID of calendar event. A recurring event might have several events, the
+// master event and its overridden instances, which all share the same UID. If the cal object
+// doesn't have any event, or its events don't have exactly one and the same UID, an error is returned.
 func EventUid(cal *ical.Calendar) (string, error) {
 	if cal == nil {
 		return "", fmt.Errorf("event is nil")
 	}
-	// get the uid from first event, not sure if this might cause issues
 	events := cal.Events()
-	if len(events) != 1 {
-		return "", fmt.Errorf("calendar has %d events, expected 1", len(events))
+	if len(events) == 0 {
+		return "", fmt.Errorf("calendar has no events")
 	}
-	propUids := events[0].Props.Values(ical.PropUID)
-	if len(propUids) != 1 {
-		return "", fmt.Errorf("length of UID prop is %d, expected 1", len(propUids))
+	var uid string
+	for _, e := range events {
+		propUids := e.Props.Values(ical.PropUID)
+		if len(propUids) != 1 {
+			return "", fmt.Errorf("length of UID prop is %d, expected 1", len(propUids))
+		}
+		if uid != "" && propUids[0].Value != uid {
+			return "", fmt.Errorf("calendar has events with different UIDs %s and %s", uid, propUids[0].Value)
+		}
+		uid = propUids[0].Value
 	}
-	return propUids[0].Value, nil
+	return uid, nil
 }
 
 // EventAttendees returns a map of email addresses of attendees to their participation status
@@ -102,11 +109,16 @@ func EventDTStart(cal *ical.Calendar) (time.Time, error) {
 	return start, nil
 }
 
-// EventDTEnd returns the latest end time from all the events in the cal object
+// EventDTEnd returns the latest end time from all the events in the cal object. For a recurring
+// event it is the end of its last occurrence. An event recurring forever has no end, the zero
+// time is returned for it.
 func EventDTEnd(cal *ical.Calendar) (time.Time, error) {
 	var end time.Time
 	for _, e := range cal.Events() {
-		dtend, err := e.DateTimeEnd(time.UTC)
+		if recursForever(&e) {
+			return time.Time{}, nil
+		}
+		dtend, err := lastOccurrenceEnd(&e)
 		if err != nil {
 			return end, err
 		}
@@ -119,3 +131,16 @@ func EventDTEnd(cal *ical.Calendar) (time.Time, error) {
 	}
 	return end, nil
 }
+
+// EventSequence returns the highest SEQUENCE of all the events in the cal object
+func EventSequence(cal *ical.Calendar) int {
+	var sequence int
+	for _, e := range cal.Events() {
+		if prop := e.Props.Get(ical.PropSequence); prop != nil {
+			if seq, err := prop.Int(); err == nil && seq > sequence {
+				sequence = seq
+			}
+		}
+	}
+	return sequence
+}
@@ -0,0 +1,151 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/teambition/rrule-go"
+)
+
+// MasterEvent returns the event of cal without a RECURRENCE-ID, or nil if all the events of cal
+// are overridden instances of a recurring event
+func MasterEvent(cal *ical.Calendar) *ical.Event {
+	for _, e := range cal.Events() {
+		if e.Props.Get(ical.PropRecurrenceID) == nil {
+			return &e
+		}
+	}
+	return nil
+}
+
+// RecurrenceID returns the RECURRENCE-ID of the event, in UTC, or an empty string for the master
+// event. Instances are matched by it across versions of the event.
+func RecurrenceID(event *ical.Component) string {
+	prop := event.Props.Get(ical.PropRecurrenceID)
+	if prop == nil {
+		return ""
+	}
+	t, err := prop.DateTime(time.UTC)
+	if err != nil {
+		return prop.Value
+	}
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// EventRecurs reports whether the event in cal is a recurring one
+func EventRecurs(cal *ical.Calendar) bool {
+	for _, e := range cal.Events() {
+		for _, name := range []string{ical.PropRecurrenceRule, ical.PropRecurrenceDates, ical.PropRecurrenceID} {
+			if e.Props.Get(name) != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RecurrenceSet returns the start times of the occurrences of the event, as defined by its
+// DTSTART, RRULE, RDATE and EXDATE properties, or nil if the event does not recur
+func RecurrenceSet(event *ical.Event) (*rrule.Set, error) {
+	roption, err := event.Props.RecurrenceRule()
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing RRULE: %v", err)
+	}
+	rdates, err := dateTimes(event.Props.Values(ical.PropRecurrenceDates))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing RDATE: %v", err)
+	}
+	if roption == nil && len(rdates) == 0 {
+		return nil, nil
+	}
+	exdates, err := dateTimes(event.Props.Values(ical.PropExceptionDates))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing EXDATE: %v", err)
+	}
+	start, err := event.DateTimeStart(time.UTC)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &rrule.Set{}
+	if roption != nil {
+		roption.Dtstart = start
+		rule, err := rrule.NewRRule(*roption)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing RRULE: %v", err)
+		}
+		set.RRule(rule)
+	} else {
+		// DTSTART is the first occurrence, the rule would otherwise generate it
+		rdates = append(rdates, start)
+	}
+	set.DTStart(start)
+	set.SetRDates(rdates)
+	set.SetExDates(exdates)
+	return set, nil
+}
+
+// recursForever reports whether the event has an RRULE without COUNT or UNTIL
+func recursForever(event *ical.Event) bool {
+	roption, err := event.Props.RecurrenceRule()
+	return err == nil && roption != nil && roption.Count == 0 && roption.Until.IsZero()
+}
+
+// lastOccurrenceEnd returns the end of the last occurrence of the recurring event
+func lastOccurrenceEnd(event *ical.Event) (time.Time, error) {
+	start, err := event.DateTimeStart(time.UTC)
+	if err != nil {
+		return time.Time{}, err
+	}
+	end, err := event.DateTimeEnd(time.UTC)
+	if err != nil {
+		return time.Time{}, err
+	}
+	set, err := RecurrenceSet(event)
+	if err != nil || set == nil {
+		return end, err
+	}
+	var last time.Time
+	next := set.Iterator()
+	for occurrence, ok := next(); ok; occurrence, ok = next() {
+		last = occurrence
+	}
+	if last.IsZero() {
+		// All the occurrences were excluded
+		return end, nil
+	}
+	return last.Add(end.Sub(start)), nil
+}
+
+// dateTimes returns the times of the RDATE or EXDATE properties, each of which might hold a
+// comma separated list of values. For periods only their start is returned.
+func dateTimes(props []ical.Prop) ([]time.Time, error) {
+	var times []time.Time
+	for _, prop := range props {
+		for _, value := range strings.Split(prop.Value, ",") {
+			single := prop
+			single.Value, _, _ = strings.Cut(value, "/")
+			if prop.ValueType() == ical.ValuePeriod {
+				single.Params = CloneParams(prop.Params)
+				single.Params.Del(ical.ParamValue)
+			}
+			t, err := single.DateTime(time.UTC)
+			if err != nil {
+				return nil, err
+			}
+			times = append(times, t)
+		}
+	}
+	return times, nil
+}
+
+// CloneParams returns a deep copy of the parameters of a property
+func CloneParams(params ical.Params) ical.Params {
+	clone := make(ical.Params, len(params))
+	for k, v := range params {
+		clone[k] = append([]string{}, v...)
+	}
+	return clone
+}